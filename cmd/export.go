@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"github.com/1ttric/shortenfs/internal"
+	"github.com/1ttric/shortenfs/internal/config"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	exportResume bool
+	exportCmd    = &cobra.Command{
+		Use:   "export [image]",
+		Short: "Writes the contents of a volume to a raw image file, or to stdout given -",
+		Long: `Writes the contents of a volume to a raw image file, or to stdout given -.
+Unwritten parts of the volume are left as holes, so the image file is sparse. The volume itself is never modified.`,
+		Args: cobra.ExactArgs(1),
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			driver := loadDriver()
+			log.Debugf("exporting volume against %s", config.MainConfig.Driver)
+			return internal.Export(driver, config.MainConfig, args[0], exportResume)
+		},
+	}
+)
+
+func init() {
+	exportCmd.Flags().BoolVar(&exportResume, "resume", false, "Continues an interrupted export into the same image "+
+		"file, provided it is of the same root ID")
+}
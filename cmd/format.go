@@ -0,0 +1,200 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/1ttric/shortenfs/internal"
+	"github.com/1ttric/shortenfs/internal/config"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Environment variable from which the passphrase of a new volume may be read
+const passphraseEnv = "SHORTENFS_PASSPHRASE"
+
+var (
+	formatDriver      string
+	formatDepth       int
+	formatCapacity    string
+	formatCompression string
+	formatPassphrase  string
+	formatAskPass     bool
+	formatKeyFile     string
+	formatForce       bool
+	formatCmd         = &cobra.Command{
+		Use:   "format",
+		Short: "Creates a new, empty volume and writes a config file for it",
+		Long: `Creates a new, empty volume and writes a config file for it, which may then be used to mount the volume.
+Any existing config file is used for driver options and other settings, but is overwritten with the new volume.`,
+		Args: cobra.NoArgs,
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if formatDepth > 0 && formatCapacity != "" {
+				return fmt.Errorf("only one of a depth or a capacity may be given")
+			}
+			capacity := 0
+			if formatCapacity != "" {
+				var err error
+				if capacity, err = parseSize(formatCapacity); err != nil {
+					return err
+				}
+			}
+			if err := applyVolumeFlags(cmd, &config.MainConfig); err != nil {
+				return err
+			}
+
+			driver := loadDriver()
+			log.Debugf("formatting volume against %s", config.MainConfig.Driver)
+			block, err := internal.Format(driver, config.MainConfig, capacity)
+			if err != nil {
+				return err
+			}
+			saveNewVolume(block, "formatted", cfgFile, &config.MainConfig)
+			return nil
+		},
+	}
+)
+
+func init() {
+	formatCmd.Flags().StringVar(&formatCapacity, "capacity", "", "Minimum capacity of the volume in bytes, "+
+		"optionally suffixed with K, M, G or T - the smallest depth providing it is used")
+	addVolumeFlags(formatCmd)
+}
+
+// Adds the flags shared by commands which create a new volume
+func addVolumeFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&formatDriver, "driver", "", "Driver to create the volume with, if not given in the "+
+		"config file")
+	cmd.Flags().IntVar(&formatDepth, "depth", 0, "Depth of the node tree")
+	cmd.Flags().StringVar(&formatCompression, "compression", "", "Compression method, \"zstd\", \"flate\" or \"none\"")
+	cmd.Flags().StringVar(&formatPassphrase, "passphrase", "", "Encrypts the volume with a key derived from this "+
+		"passphrase, which is visible to other users - prefer --ask-passphrase, --keyfile or "+passphraseEnv)
+	cmd.Flags().BoolVar(&formatAskPass, "ask-passphrase", false, "Encrypts the volume with a key derived from a "+
+		"passphrase typed at a prompt")
+	cmd.Flags().StringVar(&formatKeyFile, "keyfile", "", "Encrypts the volume with a key derived from the contents "+
+		"of this file")
+	cmd.Flags().BoolVar(&formatForce, "force", false, "Overwrites a config file which already refers to a volume")
+}
+
+// Applies the flags shared by commands which create a new volume over its config
+func applyVolumeFlags(cmd *cobra.Command, cfg *config.ShortenBlockConfig) error {
+	if cfg.RootID != "" && !formatForce {
+		return fmt.Errorf("config file already refers to volume %s - use --force to replace it", cfg.RootID)
+	}
+	if formatDriver != "" {
+		cfg.Driver = formatDriver
+	}
+	if cfg.Driver == "" {
+		return fmt.Errorf("a driver is required")
+	}
+	cfg.RootID = ""
+	cfg.RootHash = ""
+	cfg.Depth = formatDepth
+	if cmd.Flags().Changed("compression") {
+		cfg.Compression = formatCompression
+	}
+	passphrase, err := newPassphrase()
+	if err != nil {
+		return err
+	}
+	if passphrase != "" && formatKeyFile != "" {
+		return fmt.Errorf("only one of a passphrase or key file may be given")
+	}
+	if passphrase != "" {
+		cfg.Passphrase, cfg.KeyFile = passphrase, ""
+	}
+	if formatKeyFile != "" {
+		cfg.Passphrase, cfg.KeyFile = "", formatKeyFile
+	}
+	return nil
+}
+
+// Returns the passphrase given for a new volume, if any. Passphrases given on the command line can be seen by other
+// users, so they may instead be given through the environment or typed at a prompt
+func newPassphrase() (string, error) {
+	var passphrase string
+	var given int
+	if formatPassphrase != "" {
+		log.Warnf("passphrases given with --passphrase are visible to other users - prefer --ask-passphrase, "+
+			"--keyfile or %s", passphraseEnv)
+		passphrase = formatPassphrase
+		given++
+	}
+	if env := os.Getenv(passphraseEnv); env != "" {
+		passphrase = env
+		given++
+	}
+	if formatAskPass {
+		var err error
+		if passphrase, err = promptPassphrase(); err != nil {
+			return "", err
+		}
+		given++
+	}
+	if given > 1 {
+		return "", fmt.Errorf("only one of --passphrase, --ask-passphrase or %s may be given", passphraseEnv)
+	}
+	return passphrase, nil
+}
+
+// Reads a new passphrase from the terminal without echoing it, twice over to catch typing mistakes
+func promptPassphrase() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("--ask-passphrase requires a terminal")
+	}
+	var entered [2]string
+	for i, prompt := range []string{"Passphrase: ", "Repeat passphrase: "} {
+		fmt.Fprint(os.Stderr, prompt)
+		line, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", errors.Wrap(err, "could not read passphrase")
+		}
+		entered[i] = string(line)
+	}
+	if entered[0] != entered[1] {
+		return "", fmt.Errorf("passphrases do not match")
+	}
+	if entered[0] == "" {
+		return "", fmt.Errorf("passphrase is empty")
+	}
+	return entered[0], nil
+}
+
+// Points a config file at a newly created volume, and describes the volume
+func saveNewVolume(block *internal.ShortenBlock, action string, cfgFile string, cfg *config.ShortenBlockConfig) {
+	cfg.RootID = block.GetRootID()
+	cfg.RootHash = block.GetRootHash()
+	cfg.Depth = block.Depth()
+	log.Infof("saving config to file %s", cfgFile)
+	if err := config.WriteFile(cfgFile, *cfg); err != nil {
+		log.Fatal(err)
+	}
+	if err := block.Close(); err != nil {
+		log.Errorf("could not close filesystem: %s", err.Error())
+	}
+	fmt.Printf("%s volume %s/%s with depth %d and a capacity of %d bytes\n", action, cfg.Driver, cfg.RootID,
+		cfg.Depth, block.Capacity())
+}
+
+// Parses a byte count with an optional binary unit suffix, such as 512M
+func parseSize(size string) (int, error) {
+	multiplier := 1
+	trimmed := strings.TrimSuffix(strings.ToUpper(size), "B")
+	if len(trimmed) > 0 {
+		if idx := strings.IndexByte("KMGT", trimmed[len(trimmed)-1]); idx >= 0 {
+			multiplier = 1 << (10 * (idx + 1))
+			trimmed = trimmed[:len(trimmed)-1]
+		}
+	}
+	n, err := strconv.Atoi(trimmed)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return n * multiplier, nil
+}
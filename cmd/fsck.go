@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/1ttric/shortenfs/internal"
+	"github.com/1ttric/shortenfs/internal/config"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	fsckRepair bool
+	fsckCmd    = &cobra.Command{
+		Use:   "fsck",
+		Short: "Checks that every node of a volume can be read and is well-formed, reporting the byte ranges lost",
+		Long: `Checks that every node of a volume can be read and is well-formed, reporting the byte ranges lost.
+With --repair, broken nodes are replaced with zeros, producing a new root ID which is saved to the config file. The
+filesystem on the volume should then be checked in turn.`,
+		Args: cobra.NoArgs,
+		// Problems found are not a usage mistake
+		SilenceUsage: true,
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if fsckRepair {
+				if err := checkSavable(); err != nil {
+					return err
+				}
+			}
+			driver := loadDriver()
+			log.Debugf("checking volume against %s", config.MainConfig.Driver)
+			problems, err := internal.Fsck(driver, config.MainConfig, fsckRepair)
+			if err != nil {
+				return err
+			}
+			for _, problem := range problems {
+				fmt.Println(problem)
+			}
+			switch {
+			case len(problems) == 0:
+				fmt.Println("no problems found")
+			case fsckRepair:
+				fmt.Printf("repaired %d problems - the volume is now %s/%s\n", len(problems), config.MainConfig.Driver,
+					config.MainConfig.RootID)
+			default:
+				return fmt.Errorf("found %d problems", len(problems))
+			}
+			return nil
+		},
+	}
+)
+
+func init() {
+	fsckCmd.Flags().BoolVar(&fsckRepair, "repair", false, "Replaces broken nodes with zeros and saves the resulting "+
+		"root ID to the config file")
+}
@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"github.com/1ttric/shortenfs/internal"
+	"github.com/1ttric/shortenfs/internal/config"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	importCmd = &cobra.Command{
+		Use:   "import [image]",
+		Short: "Creates a new volume from a raw image file, or from stdin given -, and writes a config file for it",
+		Long: `Creates a new volume from a raw image file, or from stdin given -, and writes a config file for it.
+This is much faster than writing the image through a mount, as every node is uploaded exactly once and chunks which
+are entirely zero are not uploaded at all. Unless a depth is given, the smallest one fitting the image is used.`,
+		Args: cobra.ExactArgs(1),
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := applyVolumeFlags(cmd, &config.MainConfig); err != nil {
+				return err
+			}
+			driver := loadDriver()
+			log.Debugf("importing volume against %s", config.MainConfig.Driver)
+			block, err := internal.Import(driver, config.MainConfig, args[0])
+			if err != nil {
+				return err
+			}
+			saveNewVolume(block, "imported", cfgFile, &config.MainConfig)
+			return nil
+		},
+	}
+)
+
+func init() {
+	addVolumeFlags(importCmd)
+}
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/1ttric/shortenfs/internal"
+	"github.com/1ttric/shortenfs/internal/config"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	infoJSON bool
+	infoCmd  = &cobra.Command{
+		Use:   "info",
+		Short: "Reports the geometry of a volume and how much of it is populated, without mounting it",
+		Long: `Reports the geometry of a volume and how much of it is populated, without mounting it.
+Every node of the tree is fetched, so this takes as many requests as there are distinct nodes.`,
+		Args: cobra.NoArgs,
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			driver := loadDriver()
+			log.Debugf("inspecting volume against %s", config.MainConfig.Driver)
+			info, err := internal.Inspect(driver, config.MainConfig)
+			if err != nil {
+				return err
+			}
+			if infoJSON {
+				data, err := json.MarshalIndent(info, "", "  ")
+				if err != nil {
+					return err
+				}
+				fmt.Println(string(data))
+				return nil
+			}
+			fmt.Printf("volume:           %s/%s\n", info.Driver, info.RootID)
+			fmt.Printf("root checksum:    %s\n", valueOrNone(info.RootHash))
+			fmt.Printf("tree root:        %s\n", info.TreeRoot)
+			fmt.Printf("format version:   %d\n", info.Version)
+			fmt.Printf("depth:            %d\n", info.Depth)
+			fmt.Printf("ids per node:     %d\n", info.IdsPerNode)
+			fmt.Printf("node size:        %d bytes\n", info.NodeSize)
+			fmt.Printf("capacity:         %d bytes\n", info.Capacity)
+			fmt.Printf("compression:      %s\n", valueOrNone(info.Compression))
+			fmt.Printf("encryption:       %s\n", valueOrNone(info.Encryption))
+			fmt.Printf("checksum:         %s\n", valueOrNone(info.Checksum))
+			fmt.Printf("allocated leaves: %d\n", info.AllocatedLeaves)
+			fmt.Printf("sparse leaves:    %d\n", info.SparseLeaves)
+			fmt.Printf("stored nodes:     %d interior, %d leaves\n", info.InteriorNodes, info.StoredLeaves)
+			fmt.Printf("stored bytes:     %d\n", info.StoredBytes)
+			fmt.Printf("requests:         %d\n", info.Requests)
+			return nil
+		},
+	}
+)
+
+func init() {
+	infoCmd.Flags().BoolVar(&infoJSON, "json", false, "Prints the report as JSON")
+}
+
+func valueOrNone(value string) string {
+	if value == "" {
+		return "none"
+	}
+	return value
+}
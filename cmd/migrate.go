@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/1ttric/shortenfs/internal"
+	"github.com/1ttric/shortenfs/internal/config"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var (
+	migrateTo  string
+	migrateCmd = &cobra.Command{
+		Use:   "migrate",
+		Short: "Copies a volume into a new volume, which may use a different driver, and writes a config file for it",
+		Long: `Copies a volume into a new volume, which may use a different driver, and writes a config file for it.
+The geometry of the new volume is recomputed for its driver, and the new volume is verified against the source
+before its config file is written. Any existing target config file is used for driver options and other settings -
+otherwise, the source's settings are carried over, including its compression and encryption.`,
+		Args: cobra.NoArgs,
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if migrateTo == "" {
+				return fmt.Errorf("a target config file is required")
+			}
+			var target config.ShortenBlockConfig
+			if _, err := os.Stat(migrateTo); err == nil {
+				if target, err = config.ReadFile(migrateTo); err != nil {
+					return err
+				}
+			} else {
+				target = config.MainConfig
+				target.RootID = ""
+				target.DedupIndex = ""
+				target.History = ""
+				target.CacheDir = ""
+				target.ApplyDefaults(migrateTo)
+			}
+			if err := applyVolumeFlags(cmd, &target); err != nil {
+				return err
+			}
+
+			source := loadDriver()
+			log.Debugf("migrating volume from %s to %s", config.MainConfig.Driver, target.Driver)
+			block, err := internal.Migrate(source, config.MainConfig, openDriver(target), target)
+			if err != nil {
+				return err
+			}
+			saveNewVolume(block, "migrated to", migrateTo, &target)
+			return nil
+		},
+	}
+)
+
+func init() {
+	migrateCmd.Flags().StringVarP(&migrateTo, "to", "t", "", "Config file to write for the new volume")
+	addVolumeFlags(migrateCmd)
+}
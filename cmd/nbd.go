@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"github.com/1ttric/shortenfs/internal"
+	"github.com/1ttric/shortenfs/internal/config"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	nbdListen string
+	nbdCmd    = &cobra.Command{
+		Use:   "nbd",
+		Short: "Serves a block device running against the desired URL shortener over the Network Block Device protocol",
+		Long: `Serves a block device running against the desired URL shortener over the Network Block Device protocol.
+This needs neither FUSE nor a loop device - attach it with e.g. nbd-client -N shortenfs -u /tmp/shortenfs.sock /dev/nbd0`,
+		Args: cobra.NoArgs,
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !readOnly {
+				if err := checkSavable(); err != nil {
+					return err
+				}
+			}
+			driver := loadDriver()
+			log.Debugf("serving nbd against %s", config.MainConfig.Driver)
+			internal.ServeNBD(nbdListen, driver, readOnly)
+			return nil
+		},
+	}
+)
+
+func init() {
+	nbdCmd.Flags().StringVarP(&nbdListen, "listen", "l", "unix:/tmp/shortenfs.sock", "Address to listen on, as "+
+		"either unix:/path/to/socket or host:port")
+	nbdCmd.Flags().BoolVar(&readOnly, "readonly", false, "Serves the volume read-only, without writing to the "+
+		"shortener or saving the config file")
+}
@@ -1,25 +1,131 @@
 package cmd
 
 import (
+	"fmt"
+	"github.com/1ttric/shortenfs/internal/config"
+	"github.com/1ttric/shortenfs/internal/drivers"
+	_ "github.com/1ttric/shortenfs/internal/drivers/bitly"
+	_ "github.com/1ttric/shortenfs/internal/drivers/erasure"
+	_ "github.com/1ttric/shortenfs/internal/drivers/localdir"
+	_ "github.com/1ttric/shortenfs/internal/drivers/memory"
+	_ "github.com/1ttric/shortenfs/internal/drivers/mirror"
+	"github.com/1ttric/shortenfs/internal/drivers/retry"
+	_ "github.com/1ttric/shortenfs/internal/drivers/tinyurl"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"os"
+	"strings"
 )
 
 var (
-	rootCmd = &cobra.Command{
+	verbosity string
+	cfgFile   string
+	rootRef   string
+	// Volume the config file described before --root replaced it, as driver/id
+	configVolume string
+	rootCmd      = &cobra.Command{
 		Use:   "shortenfs",
 		Short: "Shortenfs is a FUSE-based block device that stores data in someone else's URL shortener",
 		Long: `Shortenfs implements a FUSE-based block device that writes its data into a user-configurable URL shortener.
 You may then format the block device with the filesystem of your choice and mount it.`,
+		// Errors are logged by Execute instead
+		SilenceErrors: true,
 	}
 )
 
 func init() {
+	cobra.OnInitialize(initConfig)
+	rootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "config.yml", "Specifies a shortener config file to read")
+	rootCmd.PersistentFlags().StringVarP(&verbosity, "verbosity", "v", "info", "A Logrus verbosity level")
+	rootCmd.PersistentFlags().StringVarP(&rootRef, "root", "r", "", "Uses the volume with the given root ID, as "+
+		"driver/id or driver/id:checksum, discovering its geometry rather than reading it from the config file")
+	rootCmd.AddCommand(exportCmd)
+	rootCmd.AddCommand(formatCmd)
+	rootCmd.AddCommand(fsckCmd)
+	rootCmd.AddCommand(importCmd)
+	rootCmd.AddCommand(infoCmd)
+	rootCmd.AddCommand(migrateCmd)
 	rootCmd.AddCommand(mountCmd)
+	rootCmd.AddCommand(nbdCmd)
 }
 
 func Execute() {
-	if err := mountCmd.Execute(); err != nil {
+	if err := rootCmd.Execute(); err != nil {
 		log.Fatal(err)
 	}
 }
+
+func initConfig() {
+	verbosityLvl, err := log.ParseLevel(verbosity)
+	if err != nil {
+		log.Fatalf("could not parse loglevel: %s", err.Error())
+	}
+	log.SetLevel(verbosityLvl)
+	if verbosityLvl >= log.DebugLevel {
+		log.SetReportCaller(true)
+		log.SetFormatter(&log.TextFormatter{
+			DisableColors: true,
+			FullTimestamp: true,
+		})
+	}
+	if formatCmd.CalledAs() != "" || importCmd.CalledAs() != "" {
+		// Creating a volume creates the config file, though an existing one is still used for driver options
+		if _, err := os.Stat(cfgFile); err == nil {
+			config.Read(cfgFile)
+		} else {
+			config.UseFile(cfgFile)
+		}
+		return
+	}
+	if rootRef == "" {
+		config.Read(cfgFile)
+		return
+	}
+
+	// A bare root ID needs no config file, though one is still used for driver options if present
+	if _, err := os.Stat(cfgFile); err == nil {
+		config.Read(cfgFile)
+		if config.MainConfig.RootID != "" {
+			configVolume = config.MainConfig.Driver + "/" + config.MainConfig.RootID
+		}
+	} else {
+		config.UseFile(cfgFile)
+	}
+	if idx := strings.Index(rootRef, "/"); idx >= 0 {
+		config.MainConfig.Driver = rootRef[:idx]
+		rootRef = rootRef[idx+1:]
+	}
+	config.MainConfig.RootHash = ""
+	if idx := strings.Index(rootRef, ":"); idx >= 0 {
+		config.MainConfig.RootHash = rootRef[idx+1:]
+		rootRef = rootRef[:idx]
+	}
+	config.MainConfig.RootID = rootRef
+	config.MainConfig.Depth = 0
+}
+
+// Returns an error if the volume is not the one the config file describes, as saving it would overwrite that volume's
+// root ID. Volumes given with --root must be opened read-only, or saved to a new config file
+func checkSavable() error {
+	if volume := config.MainConfig.Driver + "/" + config.MainConfig.RootID; configVolume != "" && configVolume != volume {
+		return fmt.Errorf("%s describes volume %s rather than %s - use --readonly, or give a new config file with -c",
+			cfgFile, configVolume, volume)
+	}
+	return nil
+}
+
+// Returns the configured driver, with its implementation-specific options applied
+func loadDriver() drivers.Driver {
+	return openDriver(config.MainConfig)
+}
+
+// Returns a new instance of the driver a config uses, with its implementation-specific options applied, wrapped to
+// retry failed requests and to respect the configured rate limit
+func openDriver(cfg config.ShortenBlockConfig) drivers.Driver {
+	driver, err := drivers.Open(cfg.Driver, cfg.DriverOpts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return retry.New(driver, retry.Options{Retries: cfg.Retries, Backoff: cfg.RetryBackoff,
+		MaxBackoff: cfg.RetryMaxBackoff, RateLimit: cfg.RateLimit})
+}
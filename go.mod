@@ -1,13 +1,22 @@
 module github.com/1ttric/shortenfs
 
-go 1.15
+go 1.22
 
 require (
 	bazil.org/fuse v0.0.0-20200524192727-fb710f7dfd05
+	github.com/klauspost/compress v1.18.0
 	github.com/mitchellh/mapstructure v1.1.2
-	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/pkg/errors v0.8.1
 	github.com/sirupsen/logrus v1.4.2
 	github.com/spf13/cobra v1.1.0
+	golang.org/x/crypto v0.11.0
+	golang.org/x/term v0.10.0
 	gopkg.in/yaml.v2 v2.3.0
 )
+
+require (
+	github.com/inconshreveable/mousetrap v1.0.0 // indirect
+	github.com/konsorten/go-windows-terminal-sequences v1.0.1 // indirect
+	github.com/spf13/pflag v1.0.5 // indirect
+	golang.org/x/sys v0.10.0 // indirect
+)
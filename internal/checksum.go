@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"bazil.org/fuse"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"github.com/1ttric/shortenfs/internal/drivers"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// Checksum recorded alongside each child ID in interior nodes, and alongside the tree root in the superblock: the
+	// first 128 bits of a SHA-256 hash, base64-encoded
+	checksumMethod = "sha256-128"
+	checksumLength = 22
+)
+
+// Returns the checksum of a node's contents. Trailing zeros are ignored, as drivers may pad nodes
+func nodeChecksum(data []byte) string {
+	sum := sha256.Sum256(bytes.TrimRight(data, "\x00"))
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
+
+// A reference from an interior node to one of its children. Volumes with checksums record the child's checksum
+// alongside its ID, so that the root of the tree commits to the contents of every node beneath it
+type childRef struct {
+	id   string
+	hash string
+}
+
+// Splits the contents of an interior node into references to its children, which are empty for unwritten subtrees
+func parseChildren(data []byte) []childRef {
+	var refs []childRef
+	for _, entry := range strings.Split(strings.Trim(string(data), "\x00"), ",") {
+		ref := childRef{id: entry}
+		if idx := strings.IndexByte(entry, ':'); idx >= 0 {
+			ref = childRef{id: entry[:idx], hash: entry[idx+1:]}
+		}
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+// Serializes references to children as the contents of an interior node
+func formatChildren(refs []childRef) []byte {
+	entries := make([]string, len(refs))
+	for i, ref := range refs {
+		entries[i] = ref.id
+		if ref.hash != "" {
+			entries[i] += ":" + ref.hash
+		}
+	}
+	return []byte(strings.Join(entries, ","))
+}
+
+// Returns a reference to a node which has just been written with the given contents
+func (s *ShortenBlock) newRef(id string, data []byte) childRef {
+	if id == "" || s.volume.Checksum == "" {
+		return childRef{id: id}
+	}
+	return childRef{id: id, hash: nodeChecksum(data)}
+}
+
+// Returned for nodes whose contents do not match the checksum recorded by their parent, which is reported to the
+// kernel as an I/O error
+type checksumError struct {
+	id   string
+	path string
+}
+
+func (e *checksumError) Error() string {
+	return fmt.Sprintf("node %s at %s does not match its checksum", e.id, e.path)
+}
+
+func (e *checksumError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EIO)
+}
+
+// Refuses node contents which do not match the checksum recorded for them. The level of the node and a leaf beneath it
+// locate the node in the tree for reporting
+func (s *ShortenBlock) verify(ref childRef, data []byte, level int, leafIdx int) error {
+	if s.volume.Checksum == "" || ref.hash == nodeChecksum(data) {
+		return nil
+	}
+	return &checksumError{id: ref.id, path: s.treePath(level, leafIdx)}
+}
+
+// Reads a node directly from the shortener, bypassing the cache, once a worker is free, and verifies it. A shortener
+// holding several copies of the node, such as a mirror, passes over any copy which does not match the checksum
+func (s *ShortenBlock) verifiedRead(ref childRef, level int, leafIdx int) ([]byte, error) {
+	s.workers <- struct{}{}
+	defer func() { <-s.workers }()
+	return drivers.ReadVerified(s.shortener, ref.id, func(data []byte) error {
+		return s.verify(ref, data, level, leafIdx)
+	})
+}
+
+// Describes the position of the node at the given level containing the given leaf, as the index of each child taken
+// from the root, e.g. /3/141
+func (s *ShortenBlock) treePath(level int, leafIdx int) string {
+	path := "/"
+	for i, childIdx := range s.childPath(leafIdx)[:level] {
+		if i > 0 {
+			path += "/"
+		}
+		path += strconv.Itoa(childIdx)
+	}
+	return path
+}
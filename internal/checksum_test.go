@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"bazil.org/fuse"
+	"bytes"
+	"encoding/json"
+	"github.com/1ttric/shortenfs/internal/config"
+	"github.com/1ttric/shortenfs/internal/drivers"
+	"github.com/1ttric/shortenfs/internal/drivers/memory"
+	"syscall"
+	"testing"
+)
+
+// Returns altered contents for one node, as a shortener which corrupted or replaced it might
+type tamperingDriver struct {
+	*memory.Memory
+	id string
+}
+
+func (d *tamperingDriver) Read(id string) ([]byte, error) {
+	data, err := d.Memory.Read(id)
+	if err != nil || id != d.id {
+		return data, err
+	}
+	tampered := append([]byte{}, data...)
+	tampered[0] ^= 0xff
+	return tampered, nil
+}
+
+// Holds every node twice, as a mirror does, reading the second copy only when the first is refused
+type twoCopies struct {
+	drivers.Driver
+	second drivers.Driver
+}
+
+func (d *twoCopies) ReadVerified(id string, check func(data []byte) error) ([]byte, error) {
+	if data, err := drivers.ReadVerified(d.Driver, id, check); err == nil {
+		return data, nil
+	}
+	return drivers.ReadVerified(d.second, id, check)
+}
+
+// Writes a volume holding each of the given payloads at the start of successive leaves, returning its config
+func checksummedVolume(t *testing.T, driver *memory.Memory, leaves ...[]byte) (*ShortenBlock,
+	config.ShortenBlockConfig) {
+	cfg := config.ShortenBlockConfig{Driver: "memory", Depth: 2}
+	block := NewShortenBlock(driver, cfg)
+	for i, data := range leaves {
+		if _, err := block.Write(i*driver.NodeSize(), data); err != nil {
+			t.Fatalf("write failed: %s", err.Error())
+		}
+	}
+	if err := block.Flush(); err != nil {
+		t.Fatalf("flush failed: %s", err.Error())
+	}
+	cfg.RootID, cfg.RootHash = block.GetRootID(), block.GetRootHash()
+	return block, cfg
+}
+
+// A node whose contents do not match the checksum recorded by its parent must read as an I/O error, while the rest
+// of the volume still reads
+func TestTamperedNode(t *testing.T) {
+	driver := &memory.Memory{NodeBytes: 512, IdLength: 8}
+	data := bytes.Repeat([]byte("shortenfs"), 20)
+	block, cfg := checksummedVolume(t, driver, data, bytes.ToUpper(data))
+	leaf, err := block.getLeaf(1)
+	if err != nil {
+		t.Fatalf("could not find leaf: %s", err.Error())
+	}
+
+	reopened, err := OpenReadOnly(&tamperingDriver{Memory: driver, id: leaf.id}, cfg)
+	if err != nil {
+		t.Fatalf("could not reopen volume: %s", err.Error())
+	}
+	if read, err := reopened.Read(len(data), 0); err != nil || !bytes.Equal(read, data) {
+		t.Errorf("untampered leaf does not read back (%v)", err)
+	}
+	if _, err = reopened.Read(len(data), driver.NodeSize()); err == nil {
+		t.Fatalf("tampered leaf was read")
+	}
+	if errno := fuse.ToErrno(err); errno != fuse.Errno(syscall.EIO) {
+		t.Errorf("tampered leaf reported errno %d rather than EIO", errno)
+	}
+
+	// Where another copy of the node is held, the tampered one is passed over for it
+	tampered := &tamperingDriver{Memory: driver, id: leaf.id}
+	if reopened, err = OpenReadOnly(&twoCopies{Driver: tampered, second: driver}, cfg); err != nil {
+		t.Fatalf("could not reopen volume: %s", err.Error())
+	}
+	if read, err := reopened.Read(len(data), driver.NodeSize()); err != nil || !bytes.Equal(read, bytes.ToUpper(data)) {
+		t.Errorf("tampered leaf does not read back from its other copy (%v)", err)
+	}
+}
+
+// Opening a volume with the wrong root checksum must fail, as the superblock is not the one that was shared
+func TestWrongRootHash(t *testing.T) {
+	driver := &memory.Memory{NodeBytes: 512, IdLength: 8}
+	_, cfg := checksummedVolume(t, driver, []byte("shortenfs"))
+	if _, err := OpenReadOnly(driver, cfg); err != nil {
+		t.Fatalf("could not reopen volume: %s", err.Error())
+	}
+	cfg.RootHash = nodeChecksum([]byte("some other superblock"))
+	if _, err := OpenReadOnly(driver, cfg); err == nil {
+		t.Errorf("volume was opened with the wrong root checksum")
+	}
+}
+
+// Volumes written before checksums existed record bare child IDs, and must still read
+func TestVersion1Volume(t *testing.T) {
+	driver := &memory.Memory{NodeBytes: 512, IdLength: 8}
+	data := bytes.Repeat([]byte("shortenfs"), 20)
+	leafID, err := driver.Write(data)
+	if err != nil {
+		t.Fatalf("could not write leaf: %s", err.Error())
+	}
+	// Without checksums, child references are bare IDs, each taking one byte for its separating comma
+	idsPerNode := (driver.NodeSize() + 1) / (driver.IdSize() + 1)
+	children := make([]childRef, idsPerNode)
+	children[1] = childRef{id: leafID}
+	rootID, err := driver.Write(formatChildren(children))
+	if err != nil {
+		t.Fatalf("could not write tree root: %s", err.Error())
+	}
+	sb, err := json.Marshal(superblock{Magic: superblockMagic, Version: 1, Driver: "memory", Depth: 1,
+		IdsPerNode: idsPerNode, NodeSize: driver.NodeSize(), Root: rootID})
+	if err != nil {
+		t.Fatalf("could not marshal superblock: %s", err.Error())
+	}
+	sbID, err := driver.Write(sb)
+	if err != nil {
+		t.Fatalf("could not write superblock: %s", err.Error())
+	}
+
+	block, err := OpenReadOnly(driver, config.ShortenBlockConfig{Driver: "memory", RootID: sbID})
+	if err != nil {
+		t.Fatalf("could not open version 1 volume: %s", err.Error())
+	}
+	if block.GetRootHash() != "" {
+		t.Errorf("version 1 volume has root checksum %s", block.GetRootHash())
+	}
+	read, err := block.Read(2*driver.NodeSize(), 0)
+	if err != nil {
+		t.Fatalf("could not read version 1 volume: %s", err.Error())
+	}
+	if !bytes.Equal(read[driver.NodeSize():driver.NodeSize()+len(data)], data) || !allZero(read[:driver.NodeSize()]) {
+		t.Errorf("version 1 volume does not read back what was written")
+	}
+}
@@ -1,21 +1,73 @@
 package config
 
 import (
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
 )
 
 // Defines the config for the currently used block filesystem
 type ShortenBlockConfig struct {
 	// Drive name to use for this filesystem
 	Driver string
-	// Root ID for this filesystem
+	// Root ID for this filesystem, which refers to its superblock
 	RootID string
-	// Depth of the node tree for this filesystem
+	// Checksum of the superblock, for filesystems with checksums. Along with the root ID, this identifies the entire
+	// contents of the filesystem, as every node is verified against the checksum recorded by its parent
+	RootHash string
+	// Depth of the node tree for this filesystem. May be left unset for existing filesystems, as it is recorded in the
+	// superblock
 	Depth int
 	// Driver-specific options (defined in each driver)
 	DriverOpts interface{}
+	// Compression method for new filesystems ("none", "flate" or "zstd"). Existing filesystems use whichever method is
+	// recorded in their superblock
+	Compression string
+	// Encrypts new filesystems with a key derived from either a passphrase or the contents of a key file. Existing
+	// encrypted filesystems require the same passphrase or key file
+	Passphrase string
+	KeyFile    string
+	// Number of modified leaves to buffer in memory before they are flushed to the shortener
+	MaxDirty int
+	// Interval after which modified leaves are flushed regardless of how many have accumulated
+	FlushInterval time.Duration
+	// Maximum number of concurrent requests to make to the shortener - lower this for rate-limited drivers
+	Workers int
+	// Number of times a request which failed transiently, such as through rate limiting, is retried before giving up.
+	// Negative disables retrying
+	Retries int
+	// Delay before the first retry, doubling with each further retry up to the maximum
+	RetryBackoff    time.Duration
+	RetryMaxBackoff time.Duration
+	// Maximum number of requests per second to make to the shortener, or unlimited if 0
+	RateLimit float64
+	// File remembering the IDs of previously written nodes, so that identical nodes are never uploaded twice. Defaults
+	// to a file alongside the config file, and like the other local paths, is relative to the config file's directory
+	DedupIndex string
+	// File recording every root ID the filesystem has had, each of which is a snapshot which may still be mounted.
+	// Defaults to a file alongside the config file
+	History string
+	// Most leaves to prefetch ahead of sequential reads, or negative to disable prefetching
+	Readahead int
+	// Most bytes of node contents to hold in memory, so that most reads need no request at all
+	MemoryCacheSize int64
+	// Directory caching the contents of nodes read and written, so that they are not fetched again even after a
+	// remount, and the most it may hold in bytes. Defaults to a directory alongside the config file
+	CacheDir  string
+	CacheSize int64
+
+	// Local paths as given in the config file, before ApplyDefaults resolved them
+	given localPaths
+}
+
+type localPaths struct {
+	dedupIndex string
+	history    string
+	cacheDir   string
 }
 
 var (
@@ -26,24 +78,89 @@ var (
 func Read(cfgFile string) {
 	log.Infof("using config file %s", cfgFile)
 	lastCfgFile = cfgFile
+	var err error
+	if MainConfig, err = ReadFile(cfgFile); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Reads a config file other than the main one
+func ReadFile(cfgFile string) (ShortenBlockConfig, error) {
+	var cfg ShortenBlockConfig
 	data, err := ioutil.ReadFile(cfgFile)
 	if err != nil {
-		log.Fatalf("could not read config file: %s", err.Error())
+		return cfg, fmt.Errorf("could not read config file: %s", err.Error())
 	}
-	err = yaml.Unmarshal(data, &MainConfig)
+	err = yaml.Unmarshal(data, &cfg)
 	if err != nil {
-		log.Fatalf("could not unmarshal config file: %s", err.Error())
+		return cfg, fmt.Errorf("could not unmarshal config file: %s", err.Error())
+	}
+	cfg.ApplyDefaults(cfgFile)
+	return cfg, nil
+}
+
+// Fills in settings which default to files alongside the given config file, and resolves relative paths against its
+// directory. The paths as given are kept, and are what is written back to the file
+func (cfg *ShortenBlockConfig) ApplyDefaults(cfgFile string) {
+	cfg.given = localPaths{dedupIndex: cfg.DedupIndex, history: cfg.History, cacheDir: cfg.CacheDir}
+	cfg.DedupIndex = resolvePath(cfgFile, cfg.DedupIndex, ".dedup")
+	cfg.History = resolvePath(cfgFile, cfg.History, ".history")
+	cfg.CacheDir = resolvePath(cfgFile, cfg.CacheDir, ".cache")
+}
+
+// Returns where a path given in a config file refers to, defaulting to the config file's own path with the given suffix
+func resolvePath(cfgFile string, path string, suffix string) string {
+	if path == "" {
+		return cfgFile + suffix
 	}
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(cfgFile), path)
+}
+
+// Returns the path to write to a config file for a resolved path, which is the path as given unless it has changed
+func unresolvePath(cfgFile string, resolved string, given string, suffix string) string {
+	if resolved == resolvePath(cfgFile, given, suffix) {
+		return given
+	}
+	return resolved
+}
+
+// Sets the config file to be written to, without reading it
+func UseFile(cfgFile string) {
+	log.Infof("using new config file %s", cfgFile)
+	lastCfgFile = cfgFile
+	MainConfig.ApplyDefaults(cfgFile)
 }
 
 func Write() {
 	log.Infof("saving config to file %s", lastCfgFile)
-	data, err := yaml.Marshal(MainConfig)
+	if err := WriteFile(lastCfgFile, MainConfig); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Writes a config file other than the main one. Config files holding a passphrase are only readable by their owner
+func WriteFile(cfgFile string, cfg ShortenBlockConfig) error {
+	cfg.DedupIndex = unresolvePath(cfgFile, cfg.DedupIndex, cfg.given.dedupIndex, ".dedup")
+	cfg.History = unresolvePath(cfgFile, cfg.History, cfg.given.history, ".history")
+	cfg.CacheDir = unresolvePath(cfgFile, cfg.CacheDir, cfg.given.cacheDir, ".cache")
+	data, err := yaml.Marshal(cfg)
 	if err != nil {
-		log.Fatalf("could not marshal config file: %s", err.Error())
+		return fmt.Errorf("could not marshal config file: %s", err.Error())
+	}
+	var mode os.FileMode = 0o644
+	if cfg.Passphrase != "" {
+		mode = 0o600
+		// The mode is only applied to new files, so existing files are restricted before the passphrase is written
+		if err = os.Chmod(cfgFile, mode); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not restrict config file: %s", err.Error())
+		}
 	}
-	err = ioutil.WriteFile(lastCfgFile, data, 0o644)
+	err = ioutil.WriteFile(cfgFile, data, mode)
 	if err != nil {
-		log.Fatalf("could not write config file: %s", err.Error())
+		return fmt.Errorf("could not write config file: %s", err.Error())
 	}
+	return nil
 }
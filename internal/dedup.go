@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Remembers the shortlink IDs of node payloads which have already been written, so that writing an identical payload
+// again costs no request at all. The index is an append-only file of "hash id" lines. Payloads are hashed along with a
+// scope identifying the volume's driver stack, so that an index is never consulted for IDs from an incompatible volume
+type dedupIndex struct {
+	lock  sync.Mutex
+	path  string
+	scope []byte
+	ids   map[[sha256.Size]byte]string
+	file  *os.File
+	// IDs known to still hold their payload, having been written or checked since the index was opened
+	verified map[string]bool
+
+	hits   int64
+	misses int64
+}
+
+// Loads the index at the given path, creating it if it does not yet exist
+func openDedupIndex(path string, scope string) (*dedupIndex, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open dedup index")
+	}
+	d := &dedupIndex{
+		path:     path,
+		scope:    []byte(scope),
+		ids:      make(map[[sha256.Size]byte]string),
+		file:     file,
+		verified: make(map[string]bool),
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		var hash [sha256.Size]byte
+		// A line may have been left incomplete by a crash, in which case it is skipped
+		if len(fields) != 2 || hex.DecodedLen(len(fields[0])) != len(hash) {
+			log.Warnf("skipping malformed dedup index entry %q", scanner.Text())
+			continue
+		}
+		if _, err = hex.Decode(hash[:], []byte(fields[0])); err != nil {
+			log.Warnf("skipping malformed dedup index entry %q", scanner.Text())
+			continue
+		}
+		d.ids[hash] = fields[1]
+	}
+	if err = scanner.Err(); err != nil {
+		_ = file.Close()
+		return nil, errors.Wrap(err, "could not read dedup index")
+	}
+	log.Debugf("loaded %d dedup index entries from %s", len(d.ids), path)
+	return d, nil
+}
+
+func (d *dedupIndex) hash(data []byte) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write(d.scope)
+	h.Write([]byte{0})
+	h.Write(data)
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// Returns the ID an identical payload was previously written to, if any. The first time an ID is returned after the
+// index is opened, check is called to confirm that the node still holds the payload, and the ID is forgotten if not
+func (d *dedupIndex) lookup(data []byte, check func(id string) bool) (string, bool) {
+	hash := d.hash(data)
+	d.lock.Lock()
+	id, ok := d.ids[hash]
+	verified := d.verified[id]
+	d.lock.Unlock()
+	if ok && !verified {
+		if check(id) {
+			d.lock.Lock()
+			d.verified[id] = true
+			d.lock.Unlock()
+		} else {
+			log.Warnf("node %s no longer holds its contents, so it is not reused", id)
+			if err := d.forget(id); err != nil {
+				log.Warnf("could not remove %s from dedup index: %s", id, err.Error())
+			}
+			ok = false
+		}
+	}
+	if ok {
+		atomic.AddInt64(&d.hits, 1)
+	} else {
+		atomic.AddInt64(&d.misses, 1)
+	}
+	return id, ok
+}
+
+// Records the ID a payload was written to
+func (d *dedupIndex) record(data []byte, id string) error {
+	hash := d.hash(data)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.verified[id] = true
+	if _, ok := d.ids[hash]; ok {
+		return nil
+	}
+	d.ids[hash] = id
+	if _, err := fmt.Fprintf(d.file, "%x %s\n", hash, id); err != nil {
+		return errors.Wrap(err, "could not append to dedup index")
+	}
+	return nil
+}
+
+// Removes every entry for the given IDs, such as nodes which have been lost or damaged, so that they are never reused.
+// The index file is rewritten without them
+func (d *dedupIndex) forget(ids ...string) error {
+	forgotten := make(map[string]bool)
+	for _, id := range ids {
+		forgotten[id] = true
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	removed := 0
+	for hash, id := range d.ids {
+		if forgotten[id] {
+			delete(d.ids, hash)
+			delete(d.verified, id)
+			removed++
+		}
+	}
+	if removed == 0 {
+		return nil
+	}
+	log.Debugf("removing %d entries from dedup index", removed)
+
+	// The new index is written alongside and renamed over the old one, so that a crash leaves one or the other intact
+	tmp, err := ioutil.TempFile(filepath.Dir(d.path), filepath.Base(d.path)+".tmp-")
+	if err != nil {
+		return errors.Wrap(err, "could not rewrite dedup index")
+	}
+	out := bufio.NewWriter(tmp)
+	for hash, id := range d.ids {
+		_, _ = fmt.Fprintf(out, "%x %s\n", hash, id)
+	}
+	if err = out.Flush(); err == nil {
+		err = tmp.Close()
+	} else {
+		_ = tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), d.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return errors.Wrap(err, "could not rewrite dedup index")
+	}
+	_ = d.file.Close()
+	if d.file, err = os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND, 0o600); err != nil {
+		return errors.Wrap(err, "could not reopen dedup index")
+	}
+	return nil
+}
+
+// Returns the number of lookups which found an existing ID, and the number which did not
+func (d *dedupIndex) stats() (hits int64, misses int64) {
+	return atomic.LoadInt64(&d.hits), atomic.LoadInt64(&d.misses)
+}
+
+func (d *dedupIndex) close() error {
+	return d.file.Close()
+}
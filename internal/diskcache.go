@@ -0,0 +1,254 @@
+package internal
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/1ttric/shortenfs/internal/drivers"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultCacheSize = 256 << 20
+
+var (
+	// Caches opened so far, by directory, so that volumes opened alongside each other share one size limit
+	diskCaches     = make(map[string]*diskCache)
+	diskCachesLock sync.Mutex
+)
+
+// Keeps the contents of nodes in a local directory, so that nodes fetched or written once are never fetched again,
+// even across mounts. The contents of a shortlink never change, so entries never go stale, and the least recently used
+// ones are removed once the cache exceeds its size. Each entry is a file named by the hash of its driver and ID, whose
+// modification time records when it was last used. Entries begin with a hash of their contents, so that damaged entries
+// are discarded rather than returned
+type diskCache struct {
+	dir      string
+	maxBytes int64
+
+	lock sync.Mutex
+	// Entries from most to least recently used, and the total size of their files
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+
+	hits   int64
+	misses int64
+}
+
+type cacheEntry struct {
+	name string
+	size int64
+}
+
+// Opens the cache in the given directory, creating it if it does not yet exist
+func openDiskCache(dir string, maxBytes int64) (*diskCache, error) {
+	diskCachesLock.Lock()
+	defer diskCachesLock.Unlock()
+	if c, ok := diskCaches[dir]; ok {
+		return c, nil
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultCacheSize
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, errors.Wrap(err, "could not create node cache")
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read node cache")
+	}
+	c := &diskCache{dir: dir, maxBytes: maxBytes, lru: list.New(), entries: make(map[string]*list.Element)}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+	for _, file := range files {
+		if len(file.Name()) != 2*sha256.Size || file.IsDir() {
+			// Left behind by a write interrupted by a crash
+			_ = os.Remove(filepath.Join(dir, file.Name()))
+			continue
+		}
+		c.entries[file.Name()] = c.lru.PushBack(&cacheEntry{name: file.Name(), size: file.Size()})
+		c.size += file.Size()
+	}
+	c.evict()
+	log.Debugf("loaded %d node cache entries totalling %d bytes from %s", len(c.entries), c.size, dir)
+	diskCaches[dir] = c
+	return c, nil
+}
+
+// Returns the contents of a cached node, if present
+func (c *diskCache) get(name string) ([]byte, bool) {
+	c.lock.Lock()
+	element, ok := c.entries[name]
+	if ok {
+		c.lru.MoveToFront(element)
+	}
+	c.lock.Unlock()
+	if !ok {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+	path := filepath.Join(c.dir, name)
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		// Most likely evicted since it was looked up
+		log.Debugf("could not read node cache entry %s: %s", name, err.Error())
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+	if len(contents) >= sha256.Size {
+		data := contents[sha256.Size:]
+		if sum := sha256.Sum256(data); bytes.Equal(sum[:], contents[:sha256.Size]) {
+			now := time.Now()
+			_ = os.Chtimes(path, now, now)
+			atomic.AddInt64(&c.hits, 1)
+			return data, true
+		}
+	}
+	log.Warnf("discarding damaged node cache entry %s", name)
+	c.remove(name)
+	atomic.AddInt64(&c.misses, 1)
+	return nil, false
+}
+
+// Adds a node to the cache, evicting the least recently used nodes to make room for it. Failures are only logged, as
+// the node can always be fetched again
+func (c *diskCache) put(name string, data []byte) {
+	c.lock.Lock()
+	_, ok := c.entries[name]
+	c.lock.Unlock()
+	size := int64(sha256.Size + len(data))
+	if ok || size > c.maxBytes {
+		return
+	}
+	// Written to a temporary file first, so that an entry is never seen partially written
+	file, err := ioutil.TempFile(c.dir, "tmp-")
+	if err == nil {
+		sum := sha256.Sum256(data)
+		if _, err = file.Write(sum[:]); err == nil {
+			_, err = file.Write(data)
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(file.Name(), filepath.Join(c.dir, name))
+		}
+		if err != nil {
+			_ = os.Remove(file.Name())
+		}
+	}
+	if err != nil {
+		log.Warnf("could not add %s to node cache: %s", name, err.Error())
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok = c.entries[name]; ok {
+		return
+	}
+	c.entries[name] = c.lru.PushFront(&cacheEntry{name: name, size: size})
+	c.size += size
+	c.evict()
+}
+
+// Removes an entry from the cache
+func (c *diskCache) remove(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, ok := c.entries[name]; ok {
+		c.removeElement(element)
+	}
+}
+
+// Removes the least recently used entries until the cache fits its size. The cache lock must be held
+func (c *diskCache) evict() {
+	for c.size > c.maxBytes {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// Deletes the file of an entry along with the entry itself. The cache lock must be held
+func (c *diskCache) removeElement(element *list.Element) {
+	entry := element.Value.(*cacheEntry)
+	if err := os.Remove(filepath.Join(c.dir, entry.name)); err != nil && !os.IsNotExist(err) {
+		log.Warnf("could not remove %s from node cache: %s", entry.name, err.Error())
+	}
+	c.lru.Remove(element)
+	delete(c.entries, entry.name)
+	c.size -= entry.size
+}
+
+// Returns the number of lookups which found a cached node, and the number which did not
+func (c *diskCache) stats() (hits int64, misses int64) {
+	return atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.misses)
+}
+
+// Wraps a driver so that nodes are read from the cache where possible, and nodes written are added to it. Entries are
+// named by the driver's name as well as the ID, as the same ID means different nodes on different shorteners
+type cachedDriver struct {
+	drivers.Driver
+	cache  *diskCache
+	driver string
+}
+
+func (d *cachedDriver) entryName(id string) string {
+	sum := sha256.Sum256([]byte(d.driver + "/" + id))
+	return hex.EncodeToString(sum[:])
+}
+
+// Removes a node from the cache, so that it is next read from the shortener
+func (d *cachedDriver) forget(id string) {
+	d.cache.remove(d.entryName(id))
+}
+
+func (d *cachedDriver) Read(id string) ([]byte, error) {
+	name := d.entryName(id)
+	if data, ok := d.cache.get(name); ok {
+		log.Tracef("node cache hit for id %s", id)
+		return data, nil
+	}
+	data, err := d.Driver.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	d.cache.put(name, data)
+	return data, nil
+}
+
+// Checks a cached node like any copy read from the shortener, removing it and reading the node afresh if it fails
+func (d *cachedDriver) ReadVerified(id string, check func(data []byte) error) ([]byte, error) {
+	name := d.entryName(id)
+	if data, ok := d.cache.get(name); ok {
+		if check(data) == nil {
+			log.Tracef("node cache hit for id %s", id)
+			return data, nil
+		}
+		d.cache.remove(name)
+	}
+	data, err := drivers.ReadVerified(d.Driver, id, check)
+	if err != nil {
+		return nil, err
+	}
+	d.cache.put(name, data)
+	return data, nil
+}
+
+func (d *cachedDriver) Write(data []byte) (string, error) {
+	id, err := d.Driver.Write(data)
+	if err != nil {
+		return "", err
+	}
+	d.cache.put(d.entryName(id), data)
+	return id, nil
+}
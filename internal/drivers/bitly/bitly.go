@@ -1,4 +1,6 @@
-// Note that bitly implements rate limiting that WILL kick in shortly after you start sending too many requests.
+// Note that bitly implements rate limiting that WILL kick in shortly after you start sending too many requests. Limited
+// requests fail with a drivers.HTTPError, which is retried once the requested delay has passed, but setting a rate
+// limit in the config avoids hitting the limit in the first place.
 package bitly
 
 import (
@@ -74,6 +76,10 @@ func (b Bitly) Write(data []byte) (string, error) {
 	if err != nil {
 		return "", errors.Wrap(err, "could not perform request")
 	}
+	defer resp.Body.Close()
+	if err = drivers.CheckResponse(resp); err != nil {
+		return "", err
+	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -109,6 +115,10 @@ func (b Bitly) Read(id string) ([]byte, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "could not perform request")
 	}
+	defer resp.Body.Close()
+	if err = drivers.CheckResponse(resp); err != nil {
+		return nil, err
+	}
 
 	header := resp.Header.Get("Location")
 
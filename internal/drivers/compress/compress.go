@@ -0,0 +1,155 @@
+// Compress wraps another driver, compressing each node before it is written. Every node begins with a one byte header
+// naming the method it was stored with, so nodes which did not benefit from compression are simply stored as-is
+// alongside those which did.
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"github.com/1ttric/shortenfs/internal/drivers"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	methodNone byte = iota
+	methodFlate
+	methodZstd
+)
+
+var (
+	methods = map[string]byte{
+		"none":  methodNone,
+		"flate": methodFlate,
+		"zstd":  methodZstd,
+	}
+)
+
+type Compress struct {
+	inner  drivers.Driver
+	method byte
+	// Both may be used by concurrent requests, as nodes are only ever compressed or decompressed whole
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+}
+
+// Wraps a driver, compressing nodes with the named method
+func New(inner drivers.Driver, method string) (*Compress, error) {
+	m, ok := methods[method]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression method %s", method)
+	}
+	c := &Compress{inner: inner, method: m}
+	// Nodes are small, so the window need only cover one node rather than the megabytes zstd assumes by default
+	window := zstd.MinWindowSize
+	for window < c.NodeSize() && window < zstd.MaxWindowSize {
+		window <<= 1
+	}
+	var err error
+	if c.zstdEncoder, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression),
+		zstd.WithWindowSize(window), zstd.WithLowerEncoderMem(true)); err != nil {
+		return nil, errors.Wrap(err, "could not create compressor")
+	}
+	// Nodes in any method can be read regardless of the configured one, so the decoder is always needed
+	if c.zstdDecoder, err = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(c.NodeSize())),
+		zstd.WithDecoderLowmem(true)); err != nil {
+		return nil, errors.Wrap(err, "could not create decompressor")
+	}
+	return c, nil
+}
+
+// One byte of each underlying node is used by the header
+func (c *Compress) NodeSize() int {
+	return c.inner.NodeSize() - 1
+}
+
+func (c *Compress) IdSize() int {
+	return c.inner.IdSize()
+}
+
+func (c *Compress) Write(data []byte) (string, error) {
+	node := append([]byte{methodNone}, data...)
+	switch c.method {
+	case methodFlate:
+		var buf bytes.Buffer
+		buf.WriteByte(methodFlate)
+		w, err := flate.NewWriter(&buf, flate.BestCompression)
+		if err != nil {
+			return "", errors.Wrap(err, "could not create compressor")
+		}
+		if _, err = w.Write(data); err != nil {
+			return "", errors.Wrap(err, "could not compress node")
+		}
+		if err = w.Close(); err != nil {
+			return "", errors.Wrap(err, "could not compress node")
+		}
+		if buf.Len() < len(node) {
+			node = buf.Bytes()
+		}
+	case methodZstd:
+		if compressed := c.zstdEncoder.EncodeAll(data, []byte{methodZstd}); len(compressed) < len(node) {
+			node = compressed
+		}
+	}
+	return c.inner.Write(node)
+}
+
+func (c *Compress) Read(id string) ([]byte, error) {
+	node, err := c.inner.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	return c.decompress(id, node)
+}
+
+// Checks the decompressed contents of each copy of a node, so that a copy which fails is passed over for another
+func (c *Compress) ReadVerified(id string, check func(data []byte) error) ([]byte, error) {
+	var data []byte
+	_, err := drivers.ReadVerified(c.inner, id, func(node []byte) error {
+		var err error
+		if data, err = c.decompress(id, node); err != nil {
+			return err
+		}
+		return check(data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (c *Compress) decompress(id string, node []byte) ([]byte, error) {
+	if len(node) == 0 {
+		return nil, fmt.Errorf("node %s has no compression header", id)
+	}
+	switch node[0] {
+	case methodNone:
+		return node[1:], nil
+	case methodFlate:
+		// A node can never legitimately inflate beyond the node size, so anything larger is rejected
+		r := flate.NewReader(bytes.NewReader(node[1:]))
+		defer r.Close()
+		data, err := ioutil.ReadAll(io.LimitReader(r, int64(c.NodeSize()+1)))
+		if err != nil {
+			return nil, errors.Wrap(err, "could not decompress node")
+		}
+		if len(data) > c.NodeSize() {
+			return nil, fmt.Errorf("node %s decompresses beyond the node size", id)
+		}
+		return data, nil
+	case methodZstd:
+		// The decoder refuses to produce more than the node size
+		data, err := c.zstdDecoder.DecodeAll(node[1:], nil)
+		if err == zstd.ErrDecoderSizeExceeded {
+			return nil, fmt.Errorf("node %s decompresses beyond the node size", id)
+		} else if err != nil {
+			return nil, errors.Wrap(err, "could not decompress node")
+		}
+		return data, nil
+	default:
+		return nil, fmt.Errorf("node %s has unknown compression method %d", id, node[0])
+	}
+}
@@ -0,0 +1,87 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"github.com/1ttric/shortenfs/internal/drivers/memory"
+	"github.com/klauspost/compress/zstd"
+	"math/rand"
+	"testing"
+)
+
+// Every method must return exactly what was written, whether or not the data compressed
+func TestRoundTrip(t *testing.T) {
+	inner := &memory.Memory{NodeBytes: 4096, IdLength: 8}
+	incompressible := make([]byte, 4095)
+	rand.New(rand.NewSource(1)).Read(incompressible)
+	payloads := map[string][]byte{
+		"empty":          {},
+		"zeros":          make([]byte, 4095),
+		"text":           bytes.Repeat([]byte("shortenfs "), 400),
+		"incompressible": incompressible,
+	}
+	for method, header := range methods {
+		c, err := New(inner, method)
+		if err != nil {
+			t.Fatalf("could not create %s compressor: %s", method, err.Error())
+		}
+		for name, payload := range payloads {
+			id, err := c.Write(payload)
+			if err != nil {
+				t.Fatalf("%s: could not write %s node: %s", method, name, err.Error())
+			}
+			stored, _ := inner.Read(id)
+			if len(stored) > len(payload)+1 {
+				t.Errorf("%s: %s node of %d bytes was stored as %d bytes", method, name, len(payload), len(stored))
+			}
+			if name == "incompressible" && stored[0] != methodNone {
+				t.Errorf("%s: incompressible node was stored with method %d", method, stored[0])
+			}
+			if name == "text" && stored[0] != header {
+				t.Errorf("%s: text node was stored with method %d", method, stored[0])
+			}
+			read, err := c.Read(id)
+			if err != nil {
+				t.Fatalf("%s: could not read %s node: %s", method, name, err.Error())
+			}
+			if !bytes.Equal(read, payload) {
+				t.Errorf("%s: %s node did not survive a round trip", method, name)
+			}
+		}
+	}
+}
+
+// Nodes which claim to inflate beyond the node size must be rejected rather than decompressed in full
+func TestOversizedNode(t *testing.T) {
+	inner := &memory.Memory{NodeBytes: 4096, IdLength: 8}
+	c, err := New(inner, "none")
+	if err != nil {
+		t.Fatalf("could not create compressor: %s", err.Error())
+	}
+	bomb := make([]byte, 1<<20)
+
+	var flated bytes.Buffer
+	flated.WriteByte(methodFlate)
+	w, _ := flate.NewWriter(&flated, flate.BestCompression)
+	_, _ = w.Write(bomb)
+	_ = w.Close()
+	encoder, _ := zstd.NewWriter(nil)
+	nodes := map[string][]byte{
+		"flate": flated.Bytes(),
+		"zstd":  encoder.EncodeAll(bomb, []byte{methodZstd}),
+	}
+	for method, node := range nodes {
+		id, err := inner.Write(node)
+		if err != nil {
+			t.Fatalf("%s: could not write node: %s", method, err.Error())
+		}
+		if data, err := c.Read(id); err == nil {
+			t.Errorf("%s: node inflating to %d bytes was accepted", method, len(data))
+		}
+	}
+
+	id, _ := inner.Write([]byte{0xff, 1, 2, 3})
+	if _, err := c.Read(id); err == nil {
+		t.Errorf("node with an unknown method was accepted")
+	}
+}
@@ -1,5 +1,13 @@
 package drivers
 
+import (
+	"crypto/sha512"
+	"fmt"
+	"github.com/mitchellh/mapstructure"
+	"math/big"
+	"reflect"
+)
+
 var (
 	drivers = make(map[string]Driver)
 )
@@ -13,6 +21,30 @@ func Get(name string) (Driver, bool) {
 	return driver, ok
 }
 
+// Returns a new instance of the named driver, with its implementation-specific options applied. Registered drivers
+// only serve as prototypes, so that several instances of the same driver may be used at once. Drivers which need to
+// prepare themselves once their options are known implement Initializer
+func Open(name string, opts interface{}) (Driver, error) {
+	prototype, ok := drivers[name]
+	if !ok {
+		return nil, fmt.Errorf("unregistered driver %s", name)
+	}
+	driver := prototype
+	if value := reflect.ValueOf(prototype); value.Kind() == reflect.Ptr {
+		driver = reflect.New(value.Elem().Type()).Interface().(Driver)
+	}
+	// Decode implementation-specific options into the driver struct itself
+	if err := mapstructure.Decode(opts, &driver); err != nil {
+		return nil, fmt.Errorf("invalid options for driver %s: %s", name, err.Error())
+	}
+	if initializer, ok := driver.(Initializer); ok {
+		if err := initializer.Init(); err != nil {
+			return nil, fmt.Errorf("could not open driver %s: %s", name, err.Error())
+		}
+	}
+	return driver, nil
+}
+
 type Driver interface {
 	// Returns the number of storable bytes in one shortlink
 	NodeSize() int
@@ -23,3 +55,84 @@ type Driver interface {
 	// Write data and return a shortlink
 	Write(data []byte) (shortId string, err error)
 }
+
+// One of the drivers a composite driver is built on, configured as it would be for a volume of its own
+type Member struct {
+	Driver     string      `mapstructure:"driver"`
+	DriverOpts interface{} `mapstructure:"driveropts"`
+}
+
+// Returns whether any of the given drivers is volatile, which makes a composite driver built on them volatile too
+func AnyVolatile(members []Driver) bool {
+	for _, driver := range members {
+		if IsVolatile(driver) {
+			return true
+		}
+	}
+	return false
+}
+
+// Opens each of the given members, as for Open
+func OpenMembers(members []Member) ([]Driver, error) {
+	var opened []Driver
+	for _, member := range members {
+		driver, err := Open(member.Driver, member.DriverOpts)
+		if err != nil {
+			return nil, err
+		}
+		opened = append(opened, driver)
+	}
+	return opened, nil
+}
+
+// Implemented by drivers which must do more than hold their options, such as composite drivers opening the drivers
+// they are built on. Called by Open once the options have been applied
+type Initializer interface {
+	Init() error
+}
+
+// Implemented by drivers whose nodes do not outlive the process, such as the memory driver, so that their IDs are
+// never remembered beyond it
+type Volatile interface {
+	Volatile() bool
+}
+
+// Returns whether the nodes written to a driver are lost once the process exits
+func IsVolatile(driver Driver) bool {
+	v, ok := driver.(Volatile)
+	return ok && v.Volatile()
+}
+
+// Implemented by drivers which hold several copies of each node, such as the mirror driver, so that a copy which fails
+// a check can be passed over for another. Drivers wrapping another implement it too, checking what they would return
+// from each copy, so that a copy which is corrupt but still readable is passed over wherever the check is made
+type Replicated interface {
+	// Returns the first copy of the node for which check returns nil, or the first error if there is none
+	ReadVerified(shortId string, check func(data []byte) error) (data []byte, err error)
+}
+
+// Reads a node, refusing it unless check returns nil. Drivers holding several copies of the node try each of them
+func ReadVerified(driver Driver, id string, check func(data []byte) error) ([]byte, error) {
+	if replicated, ok := driver.(Replicated); ok {
+		return replicated.ReadVerified(id, check)
+	}
+	data, err := driver.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	if err = check(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Derives an alphanumeric shortlink ID of the given length from the hash of some data, for drivers which address
+// their nodes by content. IDs are capped at the length of the full base62-encoded hash (85 characters)
+func ContentID(data []byte, size int) string {
+	sum := sha512.Sum512(data)
+	id := new(big.Int).SetBytes(sum[:]).Text(62)
+	if size < len(id) {
+		id = id[:size]
+	}
+	return id
+}
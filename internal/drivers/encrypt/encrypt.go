@@ -0,0 +1,131 @@
+// Encrypt wraps another driver, sealing each node with AES-256-GCM before it is written. Every node carries its own
+// random nonce, and nodes which fail authentication - whether tampered with, or read with the wrong key - are returned
+// as errors rather than as data.
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"github.com/1ttric/shortenfs/internal/drivers"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// Leading byte of every sealed node, so that the format can change in future
+	version byte = 1
+	KeySize      = 32
+
+	// Argon2id parameters used to stretch passphrases into keys. The nodes a key protects are public, and so open to
+	// offline guessing, which a memory-hard function makes far more costly
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+)
+
+type Encrypt struct {
+	inner drivers.Driver
+	aead  cipher.AEAD
+}
+
+// Wraps a driver, sealing nodes with the given 32 byte key
+func New(inner drivers.Driver, key []byte) (*Encrypt, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes", KeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create cipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create cipher")
+	}
+	return &Encrypt{inner: inner, aead: aead}, nil
+}
+
+// Each underlying node holds a version byte, nonce and authentication tag alongside the data
+func (e *Encrypt) NodeSize() int {
+	return e.inner.NodeSize() - 1 - e.aead.NonceSize() - e.aead.Overhead()
+}
+
+func (e *Encrypt) IdSize() int {
+	return e.inner.IdSize()
+}
+
+func (e *Encrypt) Write(data []byte) (string, error) {
+	node, err := e.Seal(data)
+	if err != nil {
+		return "", err
+	}
+	return e.inner.Write(node)
+}
+
+func (e *Encrypt) Read(id string) ([]byte, error) {
+	node, err := e.inner.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := e.Open(node)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not decrypt node %s", id)
+	}
+	return data, nil
+}
+
+// Checks the decrypted contents of each copy of a node, so that a copy which fails to authenticate or fails the check
+// is passed over for another
+func (e *Encrypt) ReadVerified(id string, check func(data []byte) error) ([]byte, error) {
+	var data []byte
+	_, err := drivers.ReadVerified(e.inner, id, func(node []byte) error {
+		var err error
+		if data, err = e.Open(node); err != nil {
+			return errors.Wrapf(err, "could not decrypt node %s", id)
+		}
+		return check(data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Encrypts and authenticates data, returning it prefixed by the version and nonce
+func (e *Encrypt) Seal(data []byte) ([]byte, error) {
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "could not generate nonce")
+	}
+	header := append([]byte{version}, nonce...)
+	return e.aead.Seal(header, nonce, data, header[:1]), nil
+}
+
+// Authenticates and decrypts data produced by Seal
+func (e *Encrypt) Open(node []byte) ([]byte, error) {
+	if len(node) < 1+e.aead.NonceSize()+e.aead.Overhead() {
+		return nil, fmt.Errorf("sealed node is truncated")
+	}
+	if node[0] != version {
+		return nil, fmt.Errorf("unknown encryption version %d", node[0])
+	}
+	nonce := node[1 : 1+e.aead.NonceSize()]
+	data, err := e.aead.Open(nil, nonce, node[1+e.aead.NonceSize():], node[:1])
+	if err != nil {
+		return nil, fmt.Errorf("authentication failed - the node has been altered, or the key is wrong")
+	}
+	return data, nil
+}
+
+// Stretches a passphrase into a key using Argon2id
+func DeriveKey(passphrase string, salt []byte) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, argon2Time, argon2Memory, argon2Threads, KeySize)
+}
+
+// Derives a key from the contents of a key file, which are assumed to already be of high entropy
+func FileKey(contents []byte) []byte {
+	sum := sha256.Sum256(contents)
+	return sum[:]
+}
@@ -0,0 +1,83 @@
+package encrypt
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/1ttric/shortenfs/internal/drivers/memory"
+	"testing"
+)
+
+func newEncrypt(t *testing.T, inner *memory.Memory, key []byte) *Encrypt {
+	e, err := New(inner, key)
+	if err != nil {
+		t.Fatalf("could not create encryptor: %s", err.Error())
+	}
+	return e
+}
+
+// Nodes must read back as written with the right key, and fail to read with anything which has been altered, rather
+// than returning the wrong data
+func TestAuthentication(t *testing.T) {
+	inner := &memory.Memory{NodeBytes: 512, IdLength: 8}
+	e := newEncrypt(t, inner, bytes.Repeat([]byte{1}, KeySize))
+	payload := bytes.Repeat([]byte("shortenfs"), 40)
+	if len(payload) > e.NodeSize() {
+		t.Fatalf("payload of %d bytes exceeds node size %d", len(payload), e.NodeSize())
+	}
+	id, err := e.Write(payload)
+	if err != nil {
+		t.Fatalf("could not write node: %s", err.Error())
+	}
+	if read, err := e.Read(id); err != nil || !bytes.Equal(read, payload) {
+		t.Fatalf("node did not survive a round trip (%v)", err)
+	}
+	sealed, _ := inner.Read(id)
+	if bytes.Contains(sealed, []byte("shortenfs")) {
+		t.Errorf("node was stored in plaintext")
+	}
+
+	wrongKey := newEncrypt(t, inner, bytes.Repeat([]byte{2}, KeySize))
+	if _, err := wrongKey.Read(id); err == nil {
+		t.Errorf("node was read with the wrong key")
+	}
+
+	altered := map[string][]byte{
+		"flipped ciphertext byte": append([]byte{}, sealed...),
+		"flipped nonce byte":      append([]byte{}, sealed...),
+		"flipped tag byte":        append([]byte{}, sealed...),
+		"truncated":               sealed[:len(sealed)-1],
+		"truncated to header":     sealed[:5],
+		"empty":                   {},
+		"unknown version":         append([]byte{}, sealed...),
+		"older version":           append([]byte{}, sealed...),
+	}
+	altered["flipped ciphertext byte"][1+12+10] ^= 0x01
+	altered["flipped nonce byte"][1] ^= 0x80
+	altered["flipped tag byte"][len(sealed)-1] ^= 0x01
+	altered["unknown version"][0] = version + 1
+	altered["older version"][0] = 0
+	for name, node := range altered {
+		id, err := inner.Write(node)
+		if err != nil {
+			t.Fatalf("%s: could not write node: %s", name, err.Error())
+		}
+		if data, err := e.Read(id); err == nil {
+			t.Errorf("%s: altered node was read as %d bytes", name, len(data))
+		}
+	}
+}
+
+// Passphrases must always stretch to the same key, so that existing volumes remain readable
+func TestDeriveKey(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	key := DeriveKey("correct horse battery staple", salt)
+	expected, _ := hex.DecodeString("efb51f9a76584f6dd6a4f7942a1a2f6ae5a6e4ec5142ff674dfd5d27eb45e446")
+	if !bytes.Equal(key, expected) {
+		t.Errorf("passphrase stretched to %x", key)
+	}
+	otherSalt := DeriveKey("correct horse battery staple", []byte("fedcba9876543210"))
+	otherPassphrase := DeriveKey("Correct horse battery staple", salt)
+	if bytes.Equal(key, otherSalt) || bytes.Equal(key, otherPassphrase) {
+		t.Errorf("different passphrases or salts derived the same key")
+	}
+}
@@ -0,0 +1,212 @@
+// The erasure driver stripes every node across several other drivers using Reed-Solomon coding, so that a volume
+// survives losing as many drivers as it has parity shards, at a fraction of the cost of mirroring. Each node is split
+// into one data shard for each driver beyond the parity ones, followed by the parity shards, and each shard is written
+// to its own driver. As with mirror, the node's ID joins the ID of each shard with dots. Reads fetch the data shards,
+// and only fall back to the parity shards to rebuild any which cannot be read.
+package erasure
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/1ttric/shortenfs/internal/drivers"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+)
+
+const (
+	separator = "."
+	// Each node begins with its length, as shards are padded to equal lengths
+	headerSize = 4
+)
+
+func init() {
+	drivers.Register("erasure", &Erasure{})
+}
+
+// Shards are limited to the size of the smallest node any backend can store
+type Erasure struct {
+	Backends []drivers.Member `mapstructure:"drivers"`
+	// Number of shards holding parity rather than data, and so the number of drivers which may be lost
+	Parity int `mapstructure:"parity"`
+
+	inner      []drivers.Driver
+	dataShards int
+	matrix     [][]byte
+}
+
+func (e *Erasure) Init() error {
+	e.dataShards = len(e.Backends) - e.Parity
+	if e.Parity < 1 || e.dataShards < 1 {
+		return fmt.Errorf("at least one data and one parity shard are needed, but %d drivers and %d parity shards "+
+			"are configured", len(e.Backends), e.Parity)
+	}
+	if len(e.Backends) > 256 {
+		return fmt.Errorf("at most 256 drivers may be used")
+	}
+	e.matrix = encodingMatrix(e.dataShards, e.Parity)
+	var err error
+	e.inner, err = drivers.OpenMembers(e.Backends)
+	return err
+}
+
+func (e *Erasure) shardSize() int {
+	size := e.inner[0].NodeSize()
+	for _, driver := range e.inner[1:] {
+		if driver.NodeSize() < size {
+			size = driver.NodeSize()
+		}
+	}
+	return size
+}
+
+func (e *Erasure) NodeSize() int {
+	return e.dataShards*e.shardSize() - headerSize
+}
+
+func (e *Erasure) IdSize() int {
+	size := len(e.inner) - 1
+	for _, driver := range e.inner {
+		size += driver.IdSize()
+	}
+	return size
+}
+
+func (e *Erasure) Volatile() bool {
+	return drivers.AnyVolatile(e.inner)
+}
+
+// Encodes a node into shards, and writes each to its driver at once. A node is only written once every shard is
+func (e *Erasure) Write(data []byte) (string, error) {
+	// Shards are only as long as needed to hold the node, so short nodes make short shards
+	shardSize := (headerSize + len(data) + e.dataShards - 1) / e.dataShards
+	payload := make([]byte, shardSize*e.dataShards)
+	binary.BigEndian.PutUint32(payload, uint32(len(data)))
+	copy(payload[headerSize:], data)
+	shards := make([][]byte, len(e.inner))
+	for i := range shards {
+		if i < e.dataShards {
+			shards[i] = payload[i*shardSize : (i+1)*shardSize]
+			continue
+		}
+		shards[i] = make([]byte, shardSize)
+		for j := 0; j < e.dataShards; j++ {
+			gfMulAdd(shards[i], shards[j], e.matrix[i][j])
+		}
+	}
+
+	ids := make([]string, len(e.inner))
+	errs := make([]error, len(e.inner))
+	var wg sync.WaitGroup
+	for i, driver := range e.inner {
+		wg.Add(1)
+		go func(i int, driver drivers.Driver) {
+			defer wg.Done()
+			ids[i], errs[i] = driver.Write(shards[i])
+		}(i, driver)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return "", errors.Wrapf(err, "could not write shard %d to %s", i, e.Backends[i].Driver)
+		}
+		if strings.Contains(ids[i], separator) {
+			return "", fmt.Errorf("%s returned ID %q containing %q", e.Backends[i].Driver, ids[i], separator)
+		}
+	}
+	return strings.Join(ids, separator), nil
+}
+
+// Reads the data shards of a node, rebuilding any which cannot be read from the parity shards
+func (e *Erasure) Read(id string) ([]byte, error) {
+	ids := strings.Split(id, separator)
+	if len(ids) != len(e.inner) {
+		return nil, fmt.Errorf("ID %q does not have one part for each of the %d drivers", id, len(e.inner))
+	}
+	shards := make([][]byte, len(e.inner))
+	missing := e.readShards(ids, shards, 0, e.dataShards)
+	if missing > 0 {
+		log.Warnf("rebuilding %d of %d data shards of %s from parity", missing, e.dataShards, id)
+		e.readShards(ids, shards, e.dataShards, len(e.inner))
+		if err := e.rebuild(shards); err != nil {
+			return nil, errors.Wrapf(err, "could not rebuild %s", id)
+		}
+	}
+
+	var payload []byte
+	for _, shard := range shards[:e.dataShards] {
+		payload = append(payload, shard...)
+	}
+	length := int(binary.BigEndian.Uint32(payload))
+	if length > len(payload)-headerSize {
+		return nil, fmt.Errorf("node %s claims to hold %d bytes, but its shards hold %d", id, length,
+			len(payload)-headerSize)
+	}
+	return payload[headerSize : headerSize+length], nil
+}
+
+// Reads the shards in the given range at once, leaving any which cannot be read as nil, and returns how many of them
+// could not be read
+func (e *Erasure) readShards(ids []string, shards [][]byte, from int, to int) int {
+	var wg sync.WaitGroup
+	for i := from; i < to; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data, err := e.inner[i].Read(ids[i])
+			if err != nil {
+				log.Warnf("could not read shard %d (%s) from %s: %s", i, ids[i], e.Backends[i].Driver, err.Error())
+				return
+			}
+			shards[i] = data
+		}(i)
+	}
+	wg.Wait()
+	missing := 0
+	for _, shard := range shards[from:to] {
+		if shard == nil {
+			missing++
+		}
+	}
+	return missing
+}
+
+// Fills in every missing data shard from any of the shards which were read, of which there must be at least as many
+// as there are data shards
+func (e *Erasure) rebuild(shards [][]byte) error {
+	var rows []int
+	for i, shard := range shards {
+		if shard != nil && len(rows) < e.dataShards {
+			if len(rows) > 0 && len(shard) != len(shards[rows[0]]) {
+				return fmt.Errorf("shards %d and %d differ in length", rows[0], i)
+			}
+			rows = append(rows, i)
+		}
+	}
+	if len(rows) < e.dataShards {
+		return fmt.Errorf("only %d of the %d shards needed could be read", len(rows), e.dataShards)
+	}
+
+	// The shards read are the data shards multiplied by the corresponding rows of the encoding matrix, so the
+	// inverse of those rows recovers the data shards
+	subMatrix := make([][]byte, e.dataShards)
+	for i, row := range rows {
+		subMatrix[i] = e.matrix[row]
+	}
+	decode, err := invert(subMatrix)
+	if err != nil {
+		return err
+	}
+	shardSize := len(shards[rows[0]])
+	for i := 0; i < e.dataShards; i++ {
+		if shards[i] != nil {
+			continue
+		}
+		shards[i] = make([]byte, shardSize)
+		for j, row := range rows {
+			gfMulAdd(shards[i], shards[row], decode[i][j])
+		}
+	}
+	return nil
+}
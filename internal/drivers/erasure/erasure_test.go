@@ -0,0 +1,193 @@
+package erasure
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/1ttric/shortenfs/internal/drivers"
+	_ "github.com/1ttric/shortenfs/internal/drivers/memory"
+	"math/rand"
+	"testing"
+)
+
+// Wraps a driver so that its reads can be made to fail, as though it were unreachable
+type failing struct {
+	drivers.Driver
+	failed bool
+}
+
+func (f *failing) Read(id string) ([]byte, error) {
+	if f.failed {
+		return nil, fmt.Errorf("driver is down")
+	}
+	return f.Driver.Read(id)
+}
+
+func newErasure(t *testing.T, dataShards int, parity int) (*Erasure, []*failing) {
+	e := &Erasure{Parity: parity}
+	for i := 0; i < dataShards+parity; i++ {
+		e.Backends = append(e.Backends, drivers.Member{Driver: "memory", DriverOpts: map[string]interface{}{
+			"nodesize": 512,
+		}})
+	}
+	if err := e.Init(); err != nil {
+		t.Fatalf("could not open %d/%d erasure driver: %s", dataShards, parity, err.Error())
+	}
+	backends := make([]*failing, len(e.inner))
+	for i, driver := range e.inner {
+		backends[i] = &failing{Driver: driver}
+		e.inner[i] = backends[i]
+	}
+	return e, backends
+}
+
+// Calls fn with every way of choosing k of the first n indices
+func combinations(n int, k int, fn func(chosen []int)) {
+	chosen := make([]int, 0, k)
+	var choose func(from int)
+	choose = func(from int) {
+		if len(chosen) == k {
+			fn(chosen)
+			return
+		}
+		for i := from; i <= n-(k-len(chosen)); i++ {
+			chosen = append(chosen, i)
+			choose(i + 1)
+			chosen = chosen[:len(chosen)-1]
+		}
+	}
+	choose(0)
+}
+
+func TestFieldArithmetic(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if product := gfMul(byte(a), gfInv(byte(a))); product != 1 {
+			t.Fatalf("%d times its inverse is %d", a, product)
+		}
+		for b := 0; b < 256; b++ {
+			// Shift-and-add multiplication, reducing by the field polynomial as it goes
+			var expected byte
+			x, y := byte(a), byte(b)
+			for ; y != 0; y >>= 1 {
+				if y&1 != 0 {
+					expected ^= x
+				}
+				carry := x&0x80 != 0
+				x <<= 1
+				if carry {
+					x ^= 0x1d
+				}
+			}
+			if product := gfMul(byte(a), byte(b)); product != expected {
+				t.Fatalf("%d times %d is %d rather than %d", a, b, product, expected)
+			}
+		}
+	}
+}
+
+// Every set of as many rows of the encoding matrix as there are data shards must be invertible, or some losses could
+// not be recovered from
+func TestEncodingMatrix(t *testing.T) {
+	for _, shards := range [][2]int{{3, 2}, {5, 3}, {10, 4}} {
+		matrix := encodingMatrix(shards[0], shards[1])
+		combinations(len(matrix), shards[0], func(rows []int) {
+			subMatrix := make([][]byte, len(rows))
+			for i, row := range rows {
+				subMatrix[i] = matrix[row]
+			}
+			inverse, err := invert(subMatrix)
+			if err != nil {
+				t.Fatalf("%d/%d rows %v: %s", shards[0], shards[1], rows, err.Error())
+			}
+			for i := range subMatrix {
+				for j := range subMatrix {
+					var product byte
+					for k := range subMatrix {
+						product ^= gfMul(subMatrix[i][k], inverse[k][j])
+					}
+					if (i == j && product != 1) || (i != j && product != 0) {
+						t.Fatalf("%d/%d rows %v: inverse is wrong at %d, %d", shards[0], shards[1], rows, i, j)
+					}
+				}
+			}
+		})
+	}
+
+	if _, err := invert([][]byte{{1, 2}, {2, 4}}); err == nil {
+		t.Errorf("singular matrix was inverted")
+	}
+}
+
+// Nodes must read back intact with any number of drivers down up to the parity, whichever drivers they are
+func TestDecode(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for _, shards := range [][2]int{{3, 2}, {5, 3}, {1, 1}, {10, 4}} {
+		e, backends := newErasure(t, shards[0], shards[1])
+		payloads := [][]byte{{}, {42}, make([]byte, e.NodeSize())}
+		for _, size := range []int{1, 7, e.NodeSize() / 3, e.NodeSize()} {
+			payload := make([]byte, size)
+			random.Read(payload)
+			payloads = append(payloads, payload)
+		}
+		ids := make([]string, len(payloads))
+		for i, payload := range payloads {
+			var err error
+			if ids[i], err = e.Write(payload); err != nil {
+				t.Fatalf("%d/%d: could not write %d bytes: %s", shards[0], shards[1], len(payload), err.Error())
+			}
+		}
+
+		for lost := 0; lost <= shards[1]; lost++ {
+			combinations(len(backends), lost, func(down []int) {
+				for _, i := range down {
+					backends[i].failed = true
+				}
+				defer func() {
+					for _, i := range down {
+						backends[i].failed = false
+					}
+				}()
+				for i, payload := range payloads {
+					read, err := e.Read(ids[i])
+					if err != nil {
+						t.Fatalf("%d/%d with drivers %v down: could not read %d bytes: %s", shards[0], shards[1], down,
+							len(payload), err.Error())
+					}
+					if !bytes.Equal(read, payload) {
+						t.Fatalf("%d/%d with drivers %v down: %d bytes read back wrongly", shards[0], shards[1], down,
+							len(payload))
+					}
+				}
+			})
+		}
+	}
+}
+
+// Losing more drivers than there are parity shards must fail the read rather than return wrong data
+func TestTooManyLost(t *testing.T) {
+	e, backends := newErasure(t, 3, 2)
+	id, err := e.Write(bytes.Repeat([]byte("shortenfs"), 20))
+	if err != nil {
+		t.Fatalf("could not write node: %s", err.Error())
+	}
+	combinations(len(backends), 3, func(down []int) {
+		for _, i := range down {
+			backends[i].failed = true
+		}
+		if data, err := e.Read(id); err == nil {
+			t.Errorf("drivers %v down: read %d bytes from only 2 shards", down, len(data))
+		}
+		for _, i := range down {
+			backends[i].failed = false
+		}
+	})
+
+	shards := make([][]byte, len(backends))
+	shards[3] = make([]byte, 8)
+	if err := e.rebuild(shards); err == nil {
+		t.Errorf("rebuilt from one shard")
+	}
+	shards[0], shards[4] = make([]byte, 8), make([]byte, 9)
+	if err := e.rebuild(shards); err == nil {
+		t.Errorf("rebuilt from shards of differing lengths")
+	}
+}
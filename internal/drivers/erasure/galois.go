@@ -0,0 +1,103 @@
+package erasure
+
+import "fmt"
+
+// Arithmetic in GF(2^8) with the polynomial x^8 + x^4 + x^3 + x^2 + 1, using log and exponent tables. Addition and
+// subtraction are both XOR. The exponent table is doubled in length so that products never need reducing modulo 255
+var (
+	gfExp [510]byte
+	gfLog [256]int
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+}
+
+func gfMul(a byte, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-gfLog[a]]
+}
+
+// Adds coefficient times src into dst
+func gfMulAdd(dst []byte, src []byte, coefficient byte) {
+	if coefficient == 0 {
+		return
+	}
+	logC := gfLog[coefficient]
+	for i, b := range src {
+		if b != 0 {
+			dst[i] ^= gfExp[logC+gfLog[b]]
+		}
+	}
+}
+
+// Returns the encoding matrix for the given numbers of data and parity shards: an identity matrix, so that data shards
+// are stored as-is, above a Cauchy matrix producing the parity shards. Every square matrix formed from any of its rows
+// is invertible, which is what allows any data shards to be rebuilt from any others
+func encodingMatrix(dataShards int, parityShards int) [][]byte {
+	matrix := make([][]byte, dataShards+parityShards)
+	for row := range matrix {
+		matrix[row] = make([]byte, dataShards)
+		for col := range matrix[row] {
+			if row < dataShards {
+				if row == col {
+					matrix[row][col] = 1
+				}
+			} else {
+				// Rows and columns are labelled by distinct field elements, so the sum is never zero
+				matrix[row][col] = gfInv(byte(row) ^ byte(col))
+			}
+		}
+	}
+	return matrix
+}
+
+// Inverts a square matrix by Gauss-Jordan elimination
+func invert(matrix [][]byte) ([][]byte, error) {
+	n := len(matrix)
+	work := make([][]byte, n)
+	for i := range matrix {
+		work[i] = make([]byte, 2*n)
+		copy(work[i], matrix[i])
+		work[i][n+i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, fmt.Errorf("matrix is singular")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		scale := gfInv(work[col][col])
+		for i := range work[col] {
+			work[col][i] = gfMul(work[col][i], scale)
+		}
+		for row := 0; row < n; row++ {
+			if row != col && work[row][col] != 0 {
+				gfMulAdd(work[row], work[col], work[row][col])
+			}
+		}
+	}
+	inverse := make([][]byte, n)
+	for i := range work {
+		inverse[i] = work[i][n:]
+	}
+	return inverse, nil
+}
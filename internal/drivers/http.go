@@ -0,0 +1,53 @@
+package drivers
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Returned by drivers when a shortener responds with an error status. RetryAfter is how long the shortener asked
+// clients to wait before trying again, if it said
+type HTTPError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("shortener responded with status %d (%s)", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// Whether the same request may succeed if repeated later, as for rate limiting and server errors
+func (e *HTTPError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusRequestTimeout ||
+		e.StatusCode >= 500
+}
+
+// Returns an HTTPError for responses with a client or server error status, discarding their body. Redirects are not
+// errors, as shortlinks are read from them
+func CheckResponse(resp *http.Response) error {
+	if resp.StatusCode < 400 {
+		return nil
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	return &HTTPError{StatusCode: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+}
+
+// Parses a Retry-After header, which is either a number of seconds or a date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
@@ -0,0 +1,96 @@
+// The localdir driver stores each node as a file in a local directory, named by its content-addressed ID. Unlike the
+// memory driver, volumes survive across mounts, which makes it suitable for CI runs and offline experimentation.
+package localdir
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/1ttric/shortenfs/internal/drivers"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func init() {
+	drivers.Register("localdir", &Localdir{})
+}
+
+// Node and ID sizes default to those of tinyurl, and may be overridden through driveropts. The storage path is
+// required, and is created on first write if it does not exist
+type Localdir struct {
+	Path      string `mapstructure:"path"`
+	NodeBytes int    `mapstructure:"nodesize"`
+	IdLength  int    `mapstructure:"idsize"`
+}
+
+func (l *Localdir) NodeSize() int {
+	if l.NodeBytes <= 0 {
+		return 6096
+	}
+	return l.NodeBytes
+}
+
+func (l *Localdir) IdSize() int {
+	if l.IdLength <= 0 {
+		return 8
+	}
+	return l.IdLength
+}
+
+func (l *Localdir) Write(data []byte) (string, error) {
+	if l.Path == "" {
+		return "", fmt.Errorf("no storage path configured")
+	}
+	if len(data) > l.NodeSize() {
+		return "", fmt.Errorf("node of %d bytes exceeds node size %d", len(data), l.NodeSize())
+	}
+	id := drivers.ContentID(data, l.IdSize())
+	nodePath := filepath.Join(l.Path, id)
+
+	// Identical content always maps to the same ID, so an existing node only needs checking for collisions
+	if existing, err := ioutil.ReadFile(nodePath); err == nil {
+		if !bytes.Equal(existing, data) {
+			return "", fmt.Errorf("content id collision on %s", id)
+		}
+		return id, nil
+	}
+
+	if err := os.MkdirAll(l.Path, 0o755); err != nil {
+		return "", errors.Wrap(err, "could not create storage path")
+	}
+	// Write to a temporary file first so that a node is never observed half-written
+	tmp, err := ioutil.TempFile(l.Path, ".tmp-")
+	if err != nil {
+		return "", errors.Wrap(err, "could not create node file")
+	}
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return "", errors.Wrap(err, "could not write node file")
+	}
+	if err = tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", errors.Wrap(err, "could not write node file")
+	}
+	if err = os.Rename(tmp.Name(), nodePath); err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", errors.Wrap(err, "could not rename node file")
+	}
+	return id, nil
+}
+
+func (l *Localdir) Read(id string) ([]byte, error) {
+	if l.Path == "" {
+		return nil, fmt.Errorf("no storage path configured")
+	}
+	// IDs are only ever alphanumeric, so anything else cannot have been written by this driver
+	if id == "" || filepath.Base(id) != id || id[0] == '.' {
+		return nil, fmt.Errorf("invalid node id %q", id)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(l.Path, id))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read node file")
+	}
+	return data, nil
+}
@@ -0,0 +1,86 @@
+package localdir
+
+import (
+	"bytes"
+	"github.com/1ttric/shortenfs/internal/drivers"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSizes(t *testing.T) {
+	driver, err := drivers.Open("localdir", map[string]interface{}{"path": t.TempDir(), "nodesize": 16, "idsize": 5})
+	if err != nil {
+		t.Fatalf("could not open driver: %s", err.Error())
+	}
+	if driver.NodeSize() != 16 || driver.IdSize() != 5 {
+		t.Fatalf("driver options gave sizes %d and %d", driver.NodeSize(), driver.IdSize())
+	}
+	id, err := driver.Write(make([]byte, 16))
+	if err != nil {
+		t.Fatalf("could not write a full node: %s", err.Error())
+	}
+	if len(id) != 5 {
+		t.Errorf("ID %q is not 5 characters", id)
+	}
+	if _, err = driver.Write(make([]byte, 17)); err == nil {
+		t.Errorf("node larger than the node size was accepted")
+	}
+}
+
+// Nodes must be stored under IDs which depend only on their content, so that they survive reopening the directory
+func TestContentAddressing(t *testing.T) {
+	dir := t.TempDir()
+	l := &Localdir{Path: filepath.Join(dir, "nodes")}
+	id, err := l.Write([]byte("shortenfs"))
+	if err != nil {
+		t.Fatalf("could not write node: %s", err.Error())
+	}
+	if again, _ := l.Write([]byte("shortenfs")); again != id {
+		t.Errorf("identical content was given IDs %s and %s", id, again)
+	}
+	if other, _ := l.Write([]byte("shortenFS")); other == id {
+		t.Errorf("different content was given the same ID %s", id)
+	}
+	if id != drivers.ContentID([]byte("shortenfs"), l.IdSize()) {
+		t.Errorf("ID %s is not the content ID", id)
+	}
+
+	reopened := &Localdir{Path: l.Path}
+	if data, err := reopened.Read(id); err != nil || !bytes.Equal(data, []byte("shortenfs")) {
+		t.Fatalf("node did not read back after reopening (%v)", err)
+	}
+	files, _ := ioutil.ReadDir(l.Path)
+	if len(files) != 2 {
+		t.Errorf("directory holds %d files rather than one per node", len(files))
+	}
+
+	// Content which does not match its ID must never be returned as another node
+	if err = ioutil.WriteFile(filepath.Join(l.Path, id), []byte("tampered"), 0o644); err != nil {
+		t.Fatalf("could not alter node: %s", err.Error())
+	}
+	if _, err = l.Write([]byte("shortenfs")); err == nil {
+		t.Errorf("write over an altered node with the same ID succeeded")
+	}
+}
+
+func TestMissingNode(t *testing.T) {
+	l := &Localdir{Path: t.TempDir()}
+	_, err := l.Read("missing1")
+	if err == nil {
+		t.Fatalf("read of a missing node succeeded")
+	}
+	if !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("read of a missing node failed with %q rather than a missing file", err.Error())
+	}
+	for _, id := range []string{"", "../escape", ".hidden", "a/b"} {
+		if _, err = l.Read(id); err == nil {
+			t.Errorf("read of invalid ID %q succeeded", id)
+		}
+	}
+	if _, err = (&Localdir{}).Write([]byte("data")); err == nil {
+		t.Errorf("write without a storage path succeeded")
+	}
+}
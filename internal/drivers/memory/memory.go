@@ -0,0 +1,69 @@
+// The memory driver keeps all nodes in process memory, and is intended for development and testing against realistic
+// geometry without reaching a real URL shortener. Nothing is persisted once the process exits.
+package memory
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/1ttric/shortenfs/internal/drivers"
+	"sync"
+)
+
+func init() {
+	drivers.Register("memory", &Memory{})
+}
+
+// Node and ID sizes default to those of tinyurl, and may be overridden through driveropts
+type Memory struct {
+	NodeBytes int `mapstructure:"nodesize"`
+	IdLength  int `mapstructure:"idsize"`
+
+	lock  sync.RWMutex
+	nodes map[string][]byte
+}
+
+func (m *Memory) NodeSize() int {
+	if m.NodeBytes <= 0 {
+		return 6096
+	}
+	return m.NodeBytes
+}
+
+func (m *Memory) IdSize() int {
+	if m.IdLength <= 0 {
+		return 8
+	}
+	return m.IdLength
+}
+
+func (m *Memory) Volatile() bool {
+	return true
+}
+
+func (m *Memory) Write(data []byte) (string, error) {
+	if len(data) > m.NodeSize() {
+		return "", fmt.Errorf("node of %d bytes exceeds node size %d", len(data), m.NodeSize())
+	}
+	id := drivers.ContentID(data, m.IdSize())
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.nodes == nil {
+		m.nodes = make(map[string][]byte)
+	}
+	if existing, ok := m.nodes[id]; ok && !bytes.Equal(existing, data) {
+		return "", fmt.Errorf("content id collision on %s", id)
+	}
+	m.nodes[id] = append([]byte{}, data...)
+	return id, nil
+}
+
+func (m *Memory) Read(id string) ([]byte, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	data, ok := m.nodes[id]
+	if !ok {
+		return nil, fmt.Errorf("no such node %s", id)
+	}
+	return append([]byte{}, data...), nil
+}
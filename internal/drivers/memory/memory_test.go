@@ -0,0 +1,66 @@
+package memory
+
+import (
+	"bytes"
+	"github.com/1ttric/shortenfs/internal/drivers"
+	"testing"
+)
+
+func TestSizes(t *testing.T) {
+	m := &Memory{}
+	if m.NodeSize() != 6096 || m.IdSize() != 8 {
+		t.Errorf("default sizes are %d and %d rather than those of tinyurl", m.NodeSize(), m.IdSize())
+	}
+
+	driver, err := drivers.Open("memory", map[string]interface{}{"nodesize": 16, "idsize": 5})
+	if err != nil {
+		t.Fatalf("could not open driver: %s", err.Error())
+	}
+	if driver.NodeSize() != 16 || driver.IdSize() != 5 {
+		t.Fatalf("driver options gave sizes %d and %d", driver.NodeSize(), driver.IdSize())
+	}
+	id, err := driver.Write(make([]byte, 16))
+	if err != nil {
+		t.Fatalf("could not write a full node: %s", err.Error())
+	}
+	if len(id) != 5 {
+		t.Errorf("ID %q is not 5 characters", id)
+	}
+	if _, err = driver.Write(make([]byte, 17)); err == nil {
+		t.Errorf("node larger than the node size was accepted")
+	}
+}
+
+// Identical content must always be given the same ID, so that it can be found again and deduplicated
+func TestContentAddressing(t *testing.T) {
+	m := &Memory{}
+	first, err := m.Write([]byte("shortenfs"))
+	if err != nil {
+		t.Fatalf("could not write node: %s", err.Error())
+	}
+	again, _ := m.Write([]byte("shortenfs"))
+	other, _ := m.Write([]byte("shortenFS"))
+	if first != again {
+		t.Errorf("identical content was given IDs %s and %s", first, again)
+	}
+	if first == other {
+		t.Errorf("different content was given the same ID %s", first)
+	}
+	// IDs depend on the content alone, rather than on the instance which wrote it
+	if id, _ := (&Memory{}).Write([]byte("shortenfs")); id != first {
+		t.Errorf("another driver gave the same content ID %s rather than %s", id, first)
+	}
+
+	data, err := m.Read(first)
+	if err != nil || !bytes.Equal(data, []byte("shortenfs")) {
+		t.Fatalf("node did not read back (%v)", err)
+	}
+	// Callers may modify what they are given without affecting the stored node
+	data[0] = 'S'
+	if data, _ = m.Read(first); data[0] != 's' {
+		t.Errorf("stored node was modified through a read")
+	}
+	if _, err = m.Read("missing"); err == nil {
+		t.Errorf("read of a missing node succeeded")
+	}
+}
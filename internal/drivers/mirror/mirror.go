@@ -0,0 +1,112 @@
+// The mirror driver replicates every node across several other drivers, so that a volume survives any one shortener
+// deleting its links or going away. Each node is written to every driver, and its ID joins the ID given by each driver
+// with dots, in the order the drivers are configured. Reads try each driver in turn until one returns a copy of the
+// node which can be read and verified.
+package mirror
+
+import (
+	"fmt"
+	"github.com/1ttric/shortenfs/internal/drivers"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+)
+
+const separator = "."
+
+func init() {
+	drivers.Register("mirror", &Mirror{})
+}
+
+// Nodes are limited to the size of the smallest node any backend can store
+type Mirror struct {
+	Backends []drivers.Member `mapstructure:"drivers"`
+
+	inner []drivers.Driver
+}
+
+func (m *Mirror) Init() error {
+	if len(m.Backends) < 2 {
+		return fmt.Errorf("at least two drivers must be mirrored")
+	}
+	var err error
+	m.inner, err = drivers.OpenMembers(m.Backends)
+	return err
+}
+
+func (m *Mirror) NodeSize() int {
+	size := m.inner[0].NodeSize()
+	for _, driver := range m.inner[1:] {
+		if driver.NodeSize() < size {
+			size = driver.NodeSize()
+		}
+	}
+	return size
+}
+
+func (m *Mirror) IdSize() int {
+	size := len(m.inner) - 1
+	for _, driver := range m.inner {
+		size += driver.IdSize()
+	}
+	return size
+}
+
+func (m *Mirror) Volatile() bool {
+	return drivers.AnyVolatile(m.inner)
+}
+
+// Writes to every backend at once. A node is only written once every backend holds a copy of it, so the volume never
+// refers to a node with fewer replicas than configured
+func (m *Mirror) Write(data []byte) (string, error) {
+	ids := make([]string, len(m.inner))
+	errs := make([]error, len(m.inner))
+	var wg sync.WaitGroup
+	for i, driver := range m.inner {
+		wg.Add(1)
+		go func(i int, driver drivers.Driver) {
+			defer wg.Done()
+			ids[i], errs[i] = driver.Write(data)
+		}(i, driver)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return "", errors.Wrapf(err, "could not write to %s", m.Backends[i].Driver)
+		}
+		if strings.Contains(ids[i], separator) {
+			return "", fmt.Errorf("%s returned ID %q containing %q", m.Backends[i].Driver, ids[i], separator)
+		}
+	}
+	return strings.Join(ids, separator), nil
+}
+
+// Reads from the first backend that returns the node, in the order they are configured
+func (m *Mirror) Read(id string) ([]byte, error) {
+	return m.ReadVerified(id, func([]byte) error {
+		return nil
+	})
+}
+
+// Reads from each backend in the order they are configured, until one returns a copy of the node which passes the
+// check. A copy which was altered by its shortener is passed over just like one which cannot be read
+func (m *Mirror) ReadVerified(id string, check func(data []byte) error) ([]byte, error) {
+	ids := strings.Split(id, separator)
+	if len(ids) != len(m.inner) {
+		return nil, fmt.Errorf("ID %q does not have one part for each of the %d mirrored drivers", id, len(m.inner))
+	}
+	var firstErr error
+	for i, driver := range m.inner {
+		data, err := drivers.ReadVerified(driver, ids[i], check)
+		if err == nil {
+			return data, nil
+		}
+		err = errors.Wrapf(err, "could not read %s from %s", ids[i], m.Backends[i].Driver)
+		log.Warn(err.Error())
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,109 @@
+package mirror
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/1ttric/shortenfs/internal/drivers"
+	_ "github.com/1ttric/shortenfs/internal/drivers/memory"
+	"testing"
+)
+
+// Wraps a driver so that its links can be made to go missing, or to lead to altered contents, as a shortener which
+// deleted or replaced them would
+type damaged struct {
+	drivers.Driver
+	missing bool
+	corrupt bool
+}
+
+func (d *damaged) Read(id string) ([]byte, error) {
+	if d.missing {
+		return nil, fmt.Errorf("link %s not found", id)
+	}
+	data, err := d.Driver.Read(id)
+	if err != nil || !d.corrupt {
+		return data, err
+	}
+	altered := append([]byte{}, data...)
+	altered[0] ^= 0xff
+	return altered, nil
+}
+
+func newMirror(t *testing.T, replicas int) (*Mirror, []*damaged) {
+	m := &Mirror{}
+	for i := 0; i < replicas; i++ {
+		m.Backends = append(m.Backends, drivers.Member{Driver: "memory", DriverOpts: map[string]interface{}{
+			"nodesize": 512,
+		}})
+	}
+	if err := m.Init(); err != nil {
+		t.Fatalf("could not open mirror of %d drivers: %s", replicas, err.Error())
+	}
+	backends := make([]*damaged, len(m.inner))
+	for i, driver := range m.inner {
+		backends[i] = &damaged{Driver: driver}
+		m.inner[i] = backends[i]
+	}
+	return m, backends
+}
+
+// Checks that a copy holds exactly the payload written, as a checksum would
+func holds(payload []byte) func(data []byte) error {
+	return func(data []byte) error {
+		if !bytes.Equal(data, payload) {
+			return fmt.Errorf("copy was altered")
+		}
+		return nil
+	}
+}
+
+// A node must read back while any one of its copies is still linked, whichever drivers have lost theirs
+func TestMissingLink(t *testing.T) {
+	m, backends := newMirror(t, 3)
+	payload := bytes.Repeat([]byte("shortenfs"), 20)
+	id, err := m.Write(payload)
+	if err != nil {
+		t.Fatalf("could not write node: %s", err.Error())
+	}
+	for _, missing := range [][]int{{}, {0}, {1}, {0, 1}, {1, 2}, {0, 2}} {
+		for _, i := range missing {
+			backends[i].missing = true
+		}
+		if data, err := m.Read(id); err != nil || !bytes.Equal(data, payload) {
+			t.Errorf("links %v missing: node does not read back (%v)", missing, err)
+		}
+		for _, i := range missing {
+			backends[i].missing = false
+		}
+	}
+
+	for _, backend := range backends {
+		backend.missing = true
+	}
+	if _, err = m.Read(id); err == nil {
+		t.Errorf("node was read with every link missing")
+	}
+}
+
+// A copy which was altered must be passed over for the next when it fails verification, rather than failing the read
+func TestCorruptLink(t *testing.T) {
+	m, backends := newMirror(t, 3)
+	payload := bytes.Repeat([]byte("shortenfs"), 20)
+	id, err := m.Write(payload)
+	if err != nil {
+		t.Fatalf("could not write node: %s", err.Error())
+	}
+	backends[0].corrupt = true
+	if data, err := m.ReadVerified(id, holds(payload)); err != nil || !bytes.Equal(data, payload) {
+		t.Errorf("first copy corrupt: node does not read back (%v)", err)
+	}
+	backends[1].missing = true
+	if data, err := m.ReadVerified(id, holds(payload)); err != nil || !bytes.Equal(data, payload) {
+		t.Errorf("first copy corrupt and second missing: node does not read back (%v)", err)
+	}
+
+	backends[1].missing, backends[1].corrupt, backends[2].corrupt = false, true, true
+	if _, err = m.ReadVerified(id, holds(payload)); err == nil {
+		t.Errorf("node was read with every copy corrupt")
+	}
+}
@@ -0,0 +1,165 @@
+// Retry wraps another driver, repeating requests which fail transiently - network errors, server errors and rate
+// limiting - with exponential backoff and jitter. Requests are also spaced out to stay within a requests-per-second
+// budget, and when a shortener asks for requests to stop for a while through Retry-After, every request made through
+// the wrapper waits.
+package retry
+
+import (
+	"github.com/1ttric/shortenfs/internal/drivers"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Zero values are replaced by defaults
+type Options struct {
+	// Number of times a failed request is repeated before giving up (default 5). Negative disables retrying
+	Retries int
+	// Delay before the first retry, doubling with each further retry up to MaxBackoff (defaults 500ms and 30s)
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Maximum number of requests started per second, or unlimited if 0
+	RateLimit float64
+}
+
+type Retry struct {
+	inner      drivers.Driver
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	// Requests are scheduled one interval apart, starting no earlier than next
+	lock     sync.Mutex
+	interval time.Duration
+	next     time.Time
+	// Replaced in tests, so that delays can be checked without waiting them out
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// Wraps a driver, retrying and rate-limiting its requests as given
+func New(inner drivers.Driver, options Options) *Retry {
+	r := &Retry{inner: inner, retries: options.Retries, backoff: options.Backoff, maxBackoff: options.MaxBackoff,
+		now: time.Now, sleep: time.Sleep}
+	if r.retries == 0 {
+		r.retries = 5
+	} else if r.retries < 0 {
+		r.retries = 0
+	}
+	if r.backoff <= 0 {
+		r.backoff = 500 * time.Millisecond
+	}
+	if r.maxBackoff <= 0 {
+		r.maxBackoff = 30 * time.Second
+	}
+	if options.RateLimit > 0 {
+		r.interval = time.Duration(float64(time.Second) / options.RateLimit)
+	}
+	return r
+}
+
+func (r *Retry) NodeSize() int {
+	return r.inner.NodeSize()
+}
+
+func (r *Retry) IdSize() int {
+	return r.inner.IdSize()
+}
+
+func (r *Retry) Volatile() bool {
+	return drivers.IsVolatile(r.inner)
+}
+
+func (r *Retry) Read(id string) ([]byte, error) {
+	var data []byte
+	err := r.do(func() error {
+		var err error
+		data, err = r.inner.Read(id)
+		return err
+	})
+	return data, err
+}
+
+func (r *Retry) ReadVerified(id string, check func(data []byte) error) ([]byte, error) {
+	var data []byte
+	err := r.do(func() error {
+		var err error
+		data, err = drivers.ReadVerified(r.inner, id, check)
+		return err
+	})
+	return data, err
+}
+
+func (r *Retry) Write(data []byte) (string, error) {
+	var id string
+	err := r.do(func() error {
+		var err error
+		id, err = r.inner.Write(data)
+		return err
+	})
+	return id, err
+}
+
+// Makes a request, repeating it until it succeeds, fails permanently, or runs out of retries
+func (r *Retry) do(request func() error) error {
+	backoff := r.backoff
+	for attempt := 0; ; attempt++ {
+		r.wait()
+		err := request()
+		if err == nil || attempt == r.retries || !transient(err) {
+			return err
+		}
+
+		// Equal jitter: wait at least half the backoff, so that concurrent requests which failed together spread out
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if httpErr, ok := errors.Cause(err).(*drivers.HTTPError); ok && httpErr.RetryAfter > 0 {
+			if httpErr.RetryAfter > delay {
+				delay = httpErr.RetryAfter
+			}
+			// The shortener is asking every client to back off, not just this request
+			r.pause(delay)
+		}
+		log.Warnf("request failed, retrying in %s (attempt %d of %d): %s", delay.Round(time.Millisecond),
+			attempt+1, r.retries, err.Error())
+		r.sleep(delay)
+		if backoff *= 2; backoff > r.maxBackoff {
+			backoff = r.maxBackoff
+		}
+	}
+}
+
+// Blocks until the next request may be started within the rate limit
+func (r *Retry) wait() {
+	r.lock.Lock()
+	now := r.now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	delay := r.next.Sub(now)
+	r.next = r.next.Add(r.interval)
+	r.lock.Unlock()
+	r.sleep(delay)
+}
+
+// Holds back every request for at least the given duration
+func (r *Retry) pause(delay time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if until := r.now().Add(delay); until.After(r.next) {
+		r.next = until
+	}
+}
+
+// Whether a request which failed with the given error may succeed if repeated. Network errors are assumed to be
+// transient, while drivers report error statuses from the shortener as HTTPErrors
+func transient(err error) bool {
+	switch cause := errors.Cause(err).(type) {
+	case *drivers.HTTPError:
+		return cause.Temporary()
+	case net.Error:
+		return true
+	}
+	return false
+}
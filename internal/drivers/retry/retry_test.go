@@ -0,0 +1,213 @@
+package retry
+
+import (
+	"fmt"
+	"github.com/1ttric/shortenfs/internal/drivers"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Fails each request with the next of its errors until they run out, after which requests succeed
+type fakeDriver struct {
+	errs     []error
+	requests int
+}
+
+func (f *fakeDriver) NodeSize() int {
+	return 512
+}
+
+func (f *fakeDriver) IdSize() int {
+	return 8
+}
+
+func (f *fakeDriver) Read(id string) ([]byte, error) {
+	if err := f.request(); err != nil {
+		return nil, err
+	}
+	return []byte(id), nil
+}
+
+func (f *fakeDriver) Write(data []byte) (string, error) {
+	if err := f.request(); err != nil {
+		return "", err
+	}
+	return "shortenf", nil
+}
+
+func (f *fakeDriver) request() error {
+	f.requests++
+	if f.requests <= len(f.errs) {
+		return f.errs[f.requests-1]
+	}
+	return nil
+}
+
+// A clock which only moves when slept on, recording each wait
+type fakeClock struct {
+	lock  sync.Mutex
+	time  time.Time
+	slept []time.Duration
+}
+
+func (c *fakeClock) now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.time
+}
+
+func (c *fakeClock) sleep(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if d > 0 {
+		c.slept = append(c.slept, d)
+		c.time = c.time.Add(d)
+	}
+}
+
+func newRetry(inner drivers.Driver, options Options) (*Retry, *fakeClock) {
+	clock := &fakeClock{time: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+	r := New(inner, options)
+	r.now, r.sleep = clock.now, clock.sleep
+	return r, clock
+}
+
+// Returns the error a driver reports for a response with the given status and Retry-After header
+func statusError(status int, retryAfter string) error {
+	resp := &http.Response{StatusCode: status, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(""))}
+	if retryAfter != "" {
+		resp.Header.Set("Retry-After", retryAfter)
+	}
+	return drivers.CheckResponse(resp)
+}
+
+func TestRetries(t *testing.T) {
+	unavailable := statusError(http.StatusServiceUnavailable, "")
+	tests := []struct {
+		name     string
+		retries  int
+		errs     []error
+		requests int
+		fails    bool
+	}{
+		{"success", 0, nil, 1, false},
+		{"server errors", 0, []error{unavailable, statusError(http.StatusBadGateway, "")}, 3, false},
+		{"rate limited", 0, []error{statusError(http.StatusTooManyRequests, "")}, 2, false},
+		{"network error", 0, []error{&net.OpError{Op: "dial", Err: fmt.Errorf("connection refused")}}, 2, false},
+		{"default retries exhausted", 0, []error{unavailable, unavailable, unavailable, unavailable, unavailable,
+			unavailable}, 6, true},
+		{"retries exhausted", 2, []error{unavailable, unavailable, unavailable}, 3, true},
+		{"retries disabled", -1, []error{unavailable}, 1, true},
+		{"client error", 0, []error{statusError(http.StatusNotFound, "")}, 1, true},
+		{"driver error", 0, []error{fmt.Errorf("node file is damaged")}, 1, true},
+	}
+	for _, test := range tests {
+		for _, op := range []string{"read", "write"} {
+			inner := &fakeDriver{errs: test.errs}
+			r, _ := newRetry(inner, Options{Retries: test.retries})
+			var err error
+			if op == "read" {
+				_, err = r.Read("shortenf")
+			} else {
+				_, err = r.Write([]byte("shortenfs"))
+			}
+			if inner.requests != test.requests {
+				t.Errorf("%s %s: made %d requests rather than %d", test.name, op, inner.requests, test.requests)
+			}
+			if fails := err != nil; fails != test.fails {
+				t.Errorf("%s %s: returned %v", test.name, op, err)
+			}
+		}
+	}
+}
+
+// Retries wait for a jittered delay of between half and all of the backoff, which doubles up to its maximum, unless the
+// shortener asks for longer
+func TestBackoff(t *testing.T) {
+	unavailable := statusError(http.StatusServiceUnavailable, "")
+	retryAfterDate := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	tests := []struct {
+		name string
+		errs []error
+		// Least and most each delay may be
+		min []time.Duration
+		max []time.Duration
+	}{
+		{"exponential", []error{unavailable, unavailable, unavailable, unavailable, unavailable},
+			[]time.Duration{50, 100, 200, 200, 200}, []time.Duration{100, 200, 400, 400, 400}},
+		{"retry-after seconds", []error{statusError(http.StatusTooManyRequests, "7")},
+			[]time.Duration{7000}, []time.Duration{7000}},
+		{"retry-after date", []error{statusError(http.StatusServiceUnavailable, retryAfterDate)},
+			[]time.Duration{time.Hour/time.Millisecond - 2000}, []time.Duration{time.Hour / time.Millisecond}},
+		{"retry-after unparseable", []error{statusError(http.StatusTooManyRequests, "soon")},
+			[]time.Duration{50}, []time.Duration{100}},
+	}
+	for _, test := range tests {
+		r, clock := newRetry(&fakeDriver{errs: test.errs}, Options{Backoff: 100 * time.Millisecond,
+			MaxBackoff: 400 * time.Millisecond})
+		if _, err := r.Read("shortenf"); err != nil {
+			t.Errorf("%s: read failed: %s", test.name, err.Error())
+			continue
+		}
+		if len(clock.slept) != len(test.min) {
+			t.Errorf("%s: waited %d times rather than %d", test.name, len(clock.slept), len(test.min))
+			continue
+		}
+		for i, delay := range clock.slept {
+			if delay < test.min[i]*time.Millisecond || delay > test.max[i]*time.Millisecond {
+				t.Errorf("%s: retry %d waited %s, outside %dms-%dms", test.name, i+1, delay, test.min[i], test.max[i])
+			}
+		}
+	}
+}
+
+// Requests are spaced out to the rate limit, and a Retry-After received by one request holds back every other
+func TestRateLimit(t *testing.T) {
+	inner := &fakeDriver{}
+	r, clock := newRetry(inner, Options{RateLimit: 4})
+	for i := 0; i < 5; i++ {
+		if _, err := r.Write([]byte("shortenfs")); err != nil {
+			t.Fatalf("write failed: %s", err.Error())
+		}
+	}
+	if len(clock.slept) != 4 {
+		t.Fatalf("5 requests waited %d times rather than 4", len(clock.slept))
+	}
+	for i, delay := range clock.slept {
+		if delay != 250*time.Millisecond {
+			t.Errorf("request %d waited %s rather than 250ms", i+2, delay)
+		}
+	}
+
+	// Once the limiter has caught up with the clock, a pause is all that holds back the next request
+	clock.sleep(time.Second)
+	clock.slept = nil
+	r.pause(10 * time.Second)
+	if _, err := r.Read("shortenf"); err != nil {
+		t.Fatalf("read failed: %s", err.Error())
+	}
+	if len(clock.slept) != 1 || clock.slept[0] != 10*time.Second {
+		t.Errorf("request after a 10s pause waited %v", clock.slept)
+	}
+
+	// A Retry-After on one request pauses the others. The first request's own waits are skipped, as though the second
+	// were made while it was waiting
+	inner.errs, inner.requests = []error{statusError(http.StatusTooManyRequests, "30")}, 0
+	r, clock = newRetry(inner, Options{})
+	r.sleep = func(time.Duration) {}
+	if _, err := r.Read("shortenf"); err != nil {
+		t.Fatalf("read failed: %s", err.Error())
+	}
+	r.sleep = clock.sleep
+	if _, err := r.Read("shortenf"); err != nil {
+		t.Fatalf("read failed: %s", err.Error())
+	}
+	if len(clock.slept) != 1 || clock.slept[0] != 30*time.Second {
+		t.Errorf("request after a 30s Retry-After waited %v", clock.slept)
+	}
+}
@@ -67,6 +67,10 @@ func (t Tinyurl) Write(data []byte) (string, error) {
 	if err != nil {
 		return "", errors.Wrap(err, "could not perform request")
 	}
+	defer resp.Body.Close()
+	if err = drivers.CheckResponse(resp); err != nil {
+		return "", err
+	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -95,6 +99,10 @@ func (t Tinyurl) Read(id string) ([]byte, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "could not perform request")
 	}
+	defer resp.Body.Close()
+	if err = drivers.CheckResponse(resp); err != nil {
+		return nil, err
+	}
 
 	header := resp.Header.Get("Location")
 
@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/1ttric/shortenfs/internal/config"
+	"github.com/1ttric/shortenfs/internal/drivers"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Interval between progress reports during long-running transfers
+const progressInterval = 5 * time.Second
+
+// Writes the contents of the configured volume to a raw image file, or to stdout if the path is "-". Unwritten parts
+// of the volume are left as holes in the file, so that the image is sparse. Leaves are exported in order, recording
+// how far the export got alongside the image so that an interrupted export can be resumed
+func Export(backend drivers.Driver, config config.ShortenBlockConfig, path string, resume bool) error {
+	s, err := OpenReadOnly(backend, config)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	rootID := s.GetRootID()
+	capacity := s.Capacity()
+
+	var out io.Writer
+	var file *os.File
+	from := 0
+	progressPath := path + ".export"
+	if path == "-" {
+		if resume {
+			return fmt.Errorf("exports to stdout cannot be resumed")
+		}
+		out = os.Stdout
+	} else {
+		flags := os.O_WRONLY | os.O_CREATE
+		if resume {
+			if from, err = readExportProgress(progressPath, rootID); err != nil {
+				return err
+			}
+			log.Infof("resuming export at byte %d", from*s.shortener.NodeSize())
+		} else {
+			flags |= os.O_TRUNC
+		}
+		if file, err = os.OpenFile(path, flags, 0o644); err != nil {
+			return errors.Wrap(err, "could not open image")
+		}
+		defer file.Close()
+		if err = file.Truncate(int64(capacity)); err != nil {
+			return errors.Wrap(err, "could not size image")
+		}
+	}
+
+	// Position up to which the image has been written, used to fill holes when writing to a stream
+	written := from * s.shortener.NodeSize()
+	lastReport := time.Now()
+	err = s.walkLeaves(from, func(firstLeaf int, refs []childRef) error {
+		leaves, err := s.fetchLeaves(firstLeaf, refs)
+		if err != nil {
+			return err
+		}
+		for i, leaf := range leaves {
+			offset := (firstLeaf + i) * s.shortener.NodeSize()
+			if file != nil {
+				// The image was truncated to size, so anything left unwritten reads back as zeros
+				if len(leaf) > 0 && !allZero(leaf) {
+					if _, err = file.WriteAt(leaf, int64(offset)); err != nil {
+						return errors.Wrap(err, "could not write image")
+					}
+				}
+				continue
+			}
+			if err = writeZeros(out, offset-written); err != nil {
+				return err
+			}
+			if _, err = out.Write(leaf); err != nil {
+				return errors.Wrap(err, "could not write image")
+			}
+			written = offset + len(leaf)
+		}
+		end := firstLeaf + len(refs)
+		if file != nil {
+			if err = ioutil.WriteFile(progressPath, []byte(fmt.Sprintf("%s %d\n", rootID, end)), 0o644); err != nil {
+				return errors.Wrap(err, "could not record export progress")
+			}
+		}
+		if time.Since(lastReport) >= progressInterval {
+			lastReport = time.Now()
+			position := end * s.shortener.NodeSize()
+			log.Infof("exported %d of %d bytes (%.1f%%)", position, capacity, 100*float64(position)/float64(capacity))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if file == nil {
+		return writeZeros(out, capacity-written)
+	}
+	if err = file.Sync(); err != nil {
+		return errors.Wrap(err, "could not write image")
+	}
+	log.Infof("exported %d bytes from volume %s", capacity, rootID)
+	return os.Remove(progressPath)
+}
+
+// Returns the leaf an interrupted export of the given root stopped at, from its progress file
+func readExportProgress(path string, rootID string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.Wrap(err, "could not read export progress")
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return 0, fmt.Errorf("malformed export progress in %s", path)
+	}
+	if fields[0] != rootID {
+		return 0, fmt.Errorf("interrupted export was of volume %s, not %s", fields[0], rootID)
+	}
+	leaf, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, fmt.Errorf("malformed export progress in %s", path)
+	}
+	return leaf, nil
+}
+
+// Writes the given number of zero bytes to a stream
+func writeZeros(out io.Writer, n int) error {
+	zeros := make([]byte, 64*1024)
+	for n > 0 {
+		chunk := zeros
+		if n < len(chunk) {
+			chunk = chunk[:n]
+		}
+		if _, err := out.Write(chunk); err != nil {
+			return errors.Wrap(err, "could not write image")
+		}
+		n -= len(chunk)
+	}
+	return nil
+}
+
+// Calls fn with references to each group of sibling leaves in order, skipping unwritten subtrees entirely along with
+// any leaves before the given index. Groups may contain empty references for unwritten leaves. Every interior node is
+// verified against its checksum as it is fetched
+func (s *ShortenBlock) walkLeaves(from int, fn func(firstLeaf int, refs []childRef) error) error {
+	root := childRef{id: s.tree.id, hash: s.tree.hash}
+	if s.depth == 0 {
+		if root.id == "" || from > 0 {
+			return nil
+		}
+		return fn(0, []childRef{root})
+	}
+	return s.walkSubtree(root, 0, 0, from, fn)
+}
+
+// Fetches the given leaves in parallel, as found by walkLeaves, and verifies them. Unwritten leaves are returned as nil
+func (s *ShortenBlock) fetchLeaves(firstLeaf int, refs []childRef) ([][]byte, error) {
+	leaves := make([][]byte, len(refs))
+	err := s.parallel(len(refs), func(i int) error {
+		if refs[i].id == "" {
+			return nil
+		}
+		var err error
+		leaves[i], err = s.verifiedRead(refs[i], s.depth, firstLeaf+i)
+		return errors.Wrapf(err, "could not read leaf %d", firstLeaf+i)
+	})
+	return leaves, err
+}
+
+func (s *ShortenBlock) walkSubtree(ref childRef, level int, firstLeaf int, from int,
+	fn func(int, []childRef) error) error {
+	span := int(math.Pow(float64(s.idsPerNode), float64(s.depth-level)))
+	if ref.id == "" || firstLeaf+span <= from {
+		return nil
+	}
+	data, err := s.verifiedRead(ref, level, firstLeaf)
+	if err != nil {
+		return errors.Wrapf(err, "could not read node %s", ref.id)
+	}
+	children := parseChildren(data)
+	if level == s.depth-1 {
+		return fn(firstLeaf, children)
+	}
+	childSpan := span / s.idsPerNode
+	for i, child := range children {
+		if err = s.walkSubtree(child, level+1, firstLeaf+i*childSpan, from, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
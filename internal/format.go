@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/1ttric/shortenfs/internal/config"
+	"github.com/1ttric/shortenfs/internal/drivers"
+)
+
+// Creates a new, empty volume by writing its superblock, so that it has a root ID before any data is written. If no
+// depth is configured, the smallest depth giving at least the requested capacity is used instead
+func Format(backend drivers.Driver, config config.ShortenBlockConfig, capacity int) (*ShortenBlock, error) {
+	s, err := createVolume(backend, config, capacity)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.commitRoot(); err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Sets up a new volume with an empty tree, without writing anything to the shortener
+func createVolume(backend drivers.Driver, config config.ShortenBlockConfig, capacity int) (*ShortenBlock, error) {
+	config.RootID = ""
+	depth := config.Depth
+	if depth <= 0 {
+		// The driver stack determines how many IDs fit in a node, so the depth is only known once it is set up
+		config.Depth = 1
+	}
+	s, err := OpenShortenBlock(backend, config)
+	if err != nil {
+		return nil, err
+	}
+	if depth <= 0 {
+		if depth, err = depthForCapacity(s.idsPerNode, s.shortener.NodeSize(), capacity); err != nil {
+			_ = s.Close()
+			return nil, err
+		}
+		s.depth = depth
+		s.volume.Depth = depth
+	}
+	return s, nil
+}
+
+// Returns the smallest tree depth whose capacity is at least the given number of bytes
+func depthForCapacity(idsPerNode int, nodeSize int, capacity int) (int, error) {
+	if capacity <= 0 {
+		return 0, fmt.Errorf("either a depth or a capacity is required")
+	}
+	if idsPerNode < 2 {
+		return 0, fmt.Errorf("nodes of %d bytes are too small to hold more than one ID", nodeSize)
+	}
+	depth, leaves := 1, idsPerNode
+	for leaves*nodeSize < capacity {
+		if leaves > int(^uint(0)>>1)/idsPerNode/nodeSize {
+			return 0, fmt.Errorf("capacity of %d bytes is too large", capacity)
+		}
+		depth++
+		leaves *= idsPerNode
+	}
+	return depth, nil
+}
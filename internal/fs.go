@@ -10,30 +10,58 @@ import (
 	log "github.com/sirupsen/logrus"
 	"os"
 	"os/signal"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 var (
 	shortenBlock *ShortenBlock
+	// Driver and config the volume was mounted with, from which snapshots are opened
+	mountDriver drivers.Driver
+	mountConfig config.ShortenBlockConfig
+	// Read-only volumes currently open for snapshots, by root ID
+	snapshotBlocks     = make(map[string]*openSnapshot)
+	snapshotBlocksLock sync.Mutex
 )
 
-func Mount(mountpoint string, driver drivers.Driver) {
-	shortenBlock = NewShortenBlock(driver, config.MainConfig)
+const (
+	// Snapshot volumes are closed once unused for this long, or once more than maxOpenSnapshots are open
+	snapshotIdleTime = time.Minute
+	maxOpenSnapshots = 4
+	// Read cache size of each snapshot volume, which would otherwise be given as much as the mounted volume
+	snapshotCacheSize = 8 << 20
+	// Writes still buffered when the volume is saved are given this many chances to be uploaded
+	finalFlushAttempts = 3
+	finalFlushDelay    = 5 * time.Second
+)
+
+// Mounts the configured volume. Read-only mounts may be of any root ID, including historical ones, as they never
+// write to the shortener or touch the volume's local files. Only the node cache is shared with them
+func Mount(mountpoint string, driver drivers.Driver, readOnly bool) {
+	shortenBlock = openVolume(driver, config.MainConfig, readOnly)
+	mountDriver, mountConfig = driver, config.MainConfig
 
 	// Unmount in case of a previous dirty exit
 	_ = fuse.Unmount(mountpoint)
 
 	// Mount
-	c, err := fuse.Mount(
-		mountpoint,
+	options := []fuse.MountOption{
 		fuse.FSName("shortenfs"),
 		fuse.Subtype("shortenfs"),
-	)
+	}
+	if readOnly {
+		options = append(options, fuse.ReadOnly())
+	}
+	c, err := fuse.Mount(mountpoint, options...)
 	if err != nil {
 		log.Fatal(err)
 	}
-	sigs := make(chan os.Signal)
-	done := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	done := make(chan struct{}, 2)
+	stopFlusher := make(chan struct{})
 	signal.Notify(sigs, syscall.SIGINT)
 	go func() {
 		<-sigs
@@ -45,13 +73,45 @@ func Mount(mountpoint string, driver drivers.Driver) {
 		_ = fs.Serve(c, FS{})
 		done <- struct{}{}
 	}()
+	if readOnly {
+		log.Infof("mounted filesystem read-only at root %s", shortenBlock.GetRootID())
+		<-done
+		_ = shortenBlock.Close()
+		return
+	}
+	go shortenBlock.RunFlusher(stopFlusher)
+	go runSnapshotCloser(stopFlusher)
 	log.Infof("mounted filesystem")
 	<-done
+	close(stopFlusher)
+	saveVolume(shortenBlock)
+}
 
-	// Update config with new root ID before exiting
-	config.MainConfig.RootID = shortenBlock.GetRootID()
+// Uploads any buffered writes, then updates the config with the new root ID before exiting. If the writes cannot be
+// uploaded, the last root which was committed is still saved, so that only the unflushed writes are lost
+func saveVolume(block *ShortenBlock) {
+	var err error
+	for attempt := 1; attempt <= finalFlushAttempts; attempt++ {
+		if err = block.Flush(); err == nil {
+			break
+		}
+		log.Errorf("could not flush pending writes (attempt %d of %d): %s", attempt, finalFlushAttempts, err.Error())
+		if attempt < finalFlushAttempts {
+			time.Sleep(finalFlushDelay)
+		}
+	}
+	config.MainConfig.RootID = block.GetRootID()
+	config.MainConfig.RootHash = block.GetRootHash()
+	config.MainConfig.Depth = block.Depth()
 	log.Infof("saving configuration")
 	config.Write()
+	if closeErr := block.Close(); closeErr != nil {
+		log.Errorf("could not close filesystem: %s", closeErr.Error())
+	}
+	if err != nil {
+		log.Fatalf("saved root %s, but %d leaves written since could not be flushed: %s", block.GetRootID(),
+			atomic.LoadInt64(&block.dirtyLeaves), err.Error())
+	}
 }
 
 type FS struct{}
@@ -72,7 +132,10 @@ func (Dir) Attr(_ context.Context, a *fuse.Attr) error {
 
 func (Dir) Lookup(_ context.Context, name string) (fs.Node, error) {
 	if name == "block" {
-		return &File{}, nil
+		return &File{block: shortenBlock, inode: 2}, nil
+	}
+	if name == "snapshots" && shortenBlock.historyPath != "" {
+		return SnapshotDir{}, nil
 	}
 	return nil, syscall.ENOENT
 }
@@ -82,24 +145,192 @@ var dirFiles = []fuse.Dirent{
 }
 
 func (Dir) ReadDirAll(_ context.Context) ([]fuse.Dirent, error) {
+	if shortenBlock.historyPath != "" {
+		return append(dirFiles, fuse.Dirent{Inode: 3, Name: "snapshots", Type: fuse.DT_Dir}), nil
+	}
 	return dirFiles, nil
 }
 
-type File struct{}
+// Lists every root ID recorded in the history as a read-only block file, named by the time it was flushed
+type SnapshotDir struct{}
+
+func (SnapshotDir) Attr(_ context.Context, a *fuse.Attr) error {
+	a.Inode = 3
+	a.Uid = 0
+	a.Gid = 0
+	a.Mode = os.ModeDir | 0o555
+	return nil
+}
+
+func snapshotName(snapshot Snapshot) string {
+	return snapshot.Time.UTC().Format("2006-01-02T15:04:05Z") + "_" + snapshot.RootID
+}
+
+func (SnapshotDir) ReadDirAll(_ context.Context) ([]fuse.Dirent, error) {
+	snapshots, err := ReadHistory(shortenBlock.historyPath)
+	if err != nil {
+		log.Errorf("could not read history: %s", err.Error())
+		return nil, err
+	}
+	var entries []fuse.Dirent
+	for i, snapshot := range snapshots {
+		// History is append-only, so a snapshot's position in it is a stable inode number
+		entries = append(entries, fuse.Dirent{Inode: uint64(4 + i), Name: snapshotName(snapshot), Type: fuse.DT_File})
+	}
+	return entries, nil
+}
+
+func (SnapshotDir) Lookup(_ context.Context, name string) (fs.Node, error) {
+	snapshots, err := ReadHistory(shortenBlock.historyPath)
+	if err != nil {
+		log.Errorf("could not read history: %s", err.Error())
+		return nil, err
+	}
+	for i, snapshot := range snapshots {
+		if snapshotName(snapshot) != name {
+			continue
+		}
+		// Opened now so that missing snapshots fail to look up, though only held open while in use
+		_, release, err := acquireSnapshot(snapshot)
+		if err != nil {
+			log.Errorf("could not open snapshot %s: %s", snapshot.RootID, err.Error())
+			return nil, err
+		}
+		release()
+		return &File{snapshot: &snapshots[i], inode: uint64(4 + i)}, nil
+	}
+	return nil, syscall.ENOENT
+}
+
+// A read-only volume opened for a snapshot, along with the number of requests using it
+type openSnapshot struct {
+	rootID   string
+	block    *ShortenBlock
+	users    int
+	lastUsed time.Time
+}
+
+// Opens a snapshot as a read-only volume, reusing it if it is already open. The returned function must be called once
+// the volume is no longer in use, after which it may be closed
+func acquireSnapshot(snapshot Snapshot) (*ShortenBlock, func(), error) {
+	snapshotBlocksLock.Lock()
+	open, ok := snapshotBlocks[snapshot.RootID]
+	if ok {
+		open.users++
+	}
+	snapshotBlocksLock.Unlock()
+	if !ok {
+		// Opening reads the superblock from the shortener, so other snapshots are not held up meanwhile
+		cfg := mountConfig
+		cfg.RootID = snapshot.RootID
+		cfg.RootHash = snapshot.RootHash
+		cfg.Depth = shortenBlock.Depth()
+		cfg.MemoryCacheSize = snapshotCacheSize
+		block, err := OpenReadOnly(mountDriver, cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		snapshotBlocksLock.Lock()
+		if open, ok = snapshotBlocks[snapshot.RootID]; ok {
+			// Another reader opened the same snapshot first
+			_ = block.Close()
+		} else {
+			open = &openSnapshot{rootID: snapshot.RootID, block: block}
+			snapshotBlocks[snapshot.RootID] = open
+		}
+		open.users++
+		snapshotBlocksLock.Unlock()
+	}
+	release := func() {
+		snapshotBlocksLock.Lock()
+		defer snapshotBlocksLock.Unlock()
+		open.users--
+		open.lastUsed = time.Now()
+		closeIdleSnapshots(false)
+	}
+	return open.block, release, nil
+}
+
+// Closes snapshot volumes which are not in use, least recently used first, until none remain which have been idle for
+// snapshotIdleTime and no more than maxOpenSnapshots are open. If all is set, every idle volume is closed. The
+// snapshot lock must be held
+func closeIdleSnapshots(all bool) {
+	var idle []*openSnapshot
+	for _, open := range snapshotBlocks {
+		if open.users == 0 {
+			idle = append(idle, open)
+		}
+	}
+	sort.Slice(idle, func(i, j int) bool {
+		return idle[i].lastUsed.Before(idle[j].lastUsed)
+	})
+	for _, open := range idle {
+		if !all && len(snapshotBlocks) <= maxOpenSnapshots && time.Since(open.lastUsed) < snapshotIdleTime {
+			return
+		}
+		log.Debugf("closing snapshot %s", open.rootID)
+		_ = open.block.Close()
+		delete(snapshotBlocks, open.rootID)
+	}
+}
+
+// Closes snapshot volumes as they become idle, and closes all of them once stopped
+func runSnapshotCloser(stop <-chan struct{}) {
+	ticker := time.NewTicker(snapshotIdleTime / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			snapshotBlocksLock.Lock()
+			closeIdleSnapshots(false)
+			snapshotBlocksLock.Unlock()
+		case <-stop:
+			snapshotBlocksLock.Lock()
+			closeIdleSnapshots(true)
+			snapshotBlocksLock.Unlock()
+			return
+		}
+	}
+}
+
+// A block file backed by a volume - either the mounted volume itself, or one of its snapshots
+type File struct {
+	block *ShortenBlock
+	// Set instead of block for snapshots, whose volumes are only held open while in use
+	snapshot *Snapshot
+	inode    uint64
+}
+
+// Returns the volume backing the file, along with a function to call once done with it
+func (f *File) acquire() (*ShortenBlock, func(), error) {
+	if f.snapshot != nil {
+		return acquireSnapshot(*f.snapshot)
+	}
+	return f.block, func() {}, nil
+}
 
 func (f *File) Attr(_ context.Context, a *fuse.Attr) error {
 	log.Trace("attr")
-	a.Inode = 2
+	a.Inode = f.inode
 	a.Gid = 0
 	a.Uid = 0
 	a.Mode = 0o777
+	if f.snapshot != nil || f.block.readOnly {
+		a.Mode &^= 0o222
+	}
+	// Snapshots share the geometry of the mounted volume, so there is no need to open them
 	a.Size = uint64(shortenBlock.Capacity())
 	return nil
 }
 
 func (f *File) Read(_ context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
 	log.Tracef("read %d, %d", req.Size, req.Offset)
-	data, err := shortenBlock.Read(req.Size, int(req.Offset))
+	block, release, err := f.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+	data, err := block.Read(req.Size, int(req.Offset))
 	if err != nil {
 		return err
 	}
@@ -109,7 +340,10 @@ func (f *File) Read(_ context.Context, req *fuse.ReadRequest, resp *fuse.ReadRes
 
 func (f *File) Write(_ context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
 	log.Tracef("write %d, %d", req.Offset, len(req.Data))
-	n, err := shortenBlock.Write(int(req.Offset), req.Data)
+	if f.snapshot != nil || f.block.readOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
+	n, err := f.block.Write(int(req.Offset), req.Data)
 	if err != nil {
 		return err
 	}
@@ -119,5 +353,8 @@ func (f *File) Write(_ context.Context, req *fuse.WriteRequest, resp *fuse.Write
 
 func (f *File) Fsync(_ context.Context, _ *fuse.FsyncRequest) error {
 	log.Trace("fsync")
-	return nil
+	if f.snapshot != nil {
+		return nil
+	}
+	return f.block.Flush()
 }
@@ -0,0 +1,238 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/1ttric/shortenfs/internal/config"
+	"github.com/1ttric/shortenfs/internal/drivers"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A node of a volume's tree which cannot be read, or whose contents are malformed. Every byte beneath it is lost
+type Problem struct {
+	// Level of the node in the tree, from 0 at the root to the depth at the leaves
+	Level  int
+	NodeID string
+	// Range of leaves and of bytes beneath the node
+	FirstLeaf int
+	LastLeaf  int
+	Start     int
+	End       int
+	Reason    string
+}
+
+func (p Problem) String() string {
+	kind := "interior node"
+	if p.FirstLeaf == p.LastLeaf {
+		kind = "leaf"
+	}
+	return fmt.Sprintf("bytes %d-%d (leaves %d-%d): %s %q at level %d %s", p.Start, p.End-1, p.FirstLeaf,
+		p.LastLeaf, kind, p.NodeID, p.Level, p.Reason)
+}
+
+// Checks every node of the given volume's tree, fetching each one from the shortener rather than the node cache.
+// Interior nodes must have one child ID for each slot, each child ID must have the driver's ID length, and on volumes
+// with checksums every node must match the checksum recorded by its parent. With repair set, every problem found is
+// replaced by an empty node, so that its range reads as zeros, and the config is updated with the resulting root.
+// Broken nodes are also removed from the dedup index and the node cache, so that they are never reused
+func Fsck(backend drivers.Driver, config config.ShortenBlockConfig, repair bool) ([]Problem, error) {
+	cfg := config
+	cfg.CacheDir = ""
+	var s *ShortenBlock
+	var err error
+	if repair {
+		s, err = OpenShortenBlock(backend, cfg)
+	} else {
+		s, err = OpenReadOnly(backend, cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &checker{s: s, leaves: make(map[string]string), lastReport: time.Now()}
+	root := childRef{id: s.tree.id, hash: s.tree.hash}
+	if s.depth == 0 {
+		c.checkLeaves(0, []childRef{root})
+	} else if c.checkID(root, 0, 0) {
+		c.checkNode(root, 0, 0)
+	}
+	sort.Slice(c.problems, func(i, j int) bool {
+		return c.problems[i].FirstLeaf < c.problems[j].FirstLeaf
+	})
+	log.Infof("checked %d interior nodes and %d leaves", c.interiorNodes, c.storedLeaves)
+
+	if !repair || len(c.problems) == 0 {
+		return c.problems, s.Close()
+	}
+	for _, problem := range c.problems {
+		if err = s.discardNode(problem.Level, problem.FirstLeaf); err != nil {
+			_ = s.Close()
+			return c.problems, err
+		}
+	}
+	log.Infof("replaced %d broken nodes with zeros", len(c.problems))
+	ids := make([]string, len(c.problems))
+	for i, problem := range c.problems {
+		ids[i] = problem.NodeID
+	}
+	if s.dedup != nil {
+		if err = s.dedup.forget(ids...); err != nil {
+			log.Warnf("could not remove broken nodes from dedup index: %s", err.Error())
+		}
+	}
+	if config.CacheDir != "" {
+		cache, err := openDiskCache(config.CacheDir, config.CacheSize)
+		if err != nil {
+			log.Warnf("could not remove broken nodes from node cache: %s", err.Error())
+		} else {
+			cached := &cachedDriver{cache: cache, driver: config.Driver}
+			for _, id := range ids {
+				cached.forget(id)
+			}
+		}
+	}
+	saveVolume(s)
+	return c.problems, nil
+}
+
+// Walks a tree, recording every problem found. Leaves are only fetched once, however many times they appear
+type checker struct {
+	s             *ShortenBlock
+	lock          sync.Mutex
+	problems      []Problem
+	leaves        map[string]string
+	interiorNodes int
+	storedLeaves  int
+	lastReport    time.Time
+}
+
+// Records a problem with the node at the given level, which contains the given leaf
+func (c *checker) report(id string, level int, firstLeaf int, reason string) {
+	span := int(math.Pow(float64(c.s.idsPerNode), float64(c.s.depth-level)))
+	nodeSize := c.s.shortener.NodeSize()
+	problem := Problem{Level: level, NodeID: id, FirstLeaf: firstLeaf, LastLeaf: firstLeaf + span - 1,
+		Start: firstLeaf * nodeSize, End: (firstLeaf + span) * nodeSize, Reason: reason}
+	log.Debug(problem.String())
+	c.lock.Lock()
+	c.problems = append(c.problems, problem)
+	c.lock.Unlock()
+}
+
+// Checks an interior node and everything beneath it
+func (c *checker) checkNode(ref childRef, level int, firstLeaf int) {
+	data, err := c.s.verifiedRead(ref, level, firstLeaf)
+	c.interiorNodes++
+	if err != nil {
+		c.report(ref.id, level, firstLeaf, readProblem(err))
+		return
+	}
+	children := parseChildren(data)
+	if len(children) != c.s.idsPerNode {
+		c.report(ref.id, level, firstLeaf, fmt.Sprintf("has %d children rather than %d", len(children),
+			c.s.idsPerNode))
+		return
+	}
+	childSpan := int(math.Pow(float64(c.s.idsPerNode), float64(c.s.depth-level-1)))
+	if level == c.s.depth-1 {
+		c.checkLeaves(firstLeaf, children)
+	} else {
+		for i, child := range children {
+			if c.checkID(child, level+1, firstLeaf+i*childSpan) {
+				c.checkNode(child, level+1, firstLeaf+i*childSpan)
+			}
+		}
+	}
+
+	if time.Since(c.lastReport) >= progressInterval {
+		c.lastReport = time.Now()
+		position := (firstLeaf + childSpan*len(children)) * c.s.shortener.NodeSize()
+		log.Infof("checked up to byte %d of %d (%.1f%%)", position, c.s.Capacity(),
+			100*float64(position)/float64(c.s.Capacity()))
+	}
+}
+
+// Checks the length of a child ID and of its checksum, returning whether the child can be fetched
+func (c *checker) checkID(ref childRef, level int, firstLeaf int) bool {
+	if ref.id == "" {
+		return false
+	}
+	if len(ref.id) != c.s.shortener.IdSize() {
+		c.report(ref.id, level, firstLeaf, fmt.Sprintf("has an ID of length %d rather than %d", len(ref.id),
+			c.s.shortener.IdSize()))
+		return false
+	}
+	if c.s.volume.Checksum != "" && len(ref.hash) != checksumLength {
+		c.report(ref.id, level, firstLeaf, fmt.Sprintf("has a checksum of length %d rather than %d", len(ref.hash),
+			checksumLength))
+		return false
+	}
+	return true
+}
+
+// Fetches a group of sibling leaves in parallel. Leaves are remembered by their ID and checksum, as a deduplicated leaf
+// may be referenced correctly in one place and with a mismatched checksum in another
+func (c *checker) checkLeaves(firstLeaf int, refs []childRef) {
+	_ = c.s.parallel(len(refs), func(i int) error {
+		ref := refs[i]
+		if !c.checkID(ref, c.s.depth, firstLeaf+i) {
+			return nil
+		}
+		key := ref.id + ":" + ref.hash
+		c.lock.Lock()
+		reason, ok := c.leaves[key]
+		c.lock.Unlock()
+		if !ok {
+			data, err := c.s.verifiedRead(ref, c.s.depth, firstLeaf+i)
+			if err != nil {
+				reason = readProblem(err)
+			} else if len(data) > c.s.shortener.NodeSize() {
+				reason = fmt.Sprintf("holds %d bytes rather than at most %d", len(data), c.s.shortener.NodeSize())
+			}
+			c.lock.Lock()
+			c.leaves[key] = reason
+			c.storedLeaves++
+			c.lock.Unlock()
+		}
+		if reason != "" {
+			c.report(ref.id, c.s.depth, firstLeaf+i, reason)
+		}
+		return nil
+	})
+}
+
+// Describes why a node could not be read. Nodes of which no copy matches the checksum are told apart from those which
+// could not be read at all
+func readProblem(err error) string {
+	if _, ok := errors.Cause(err).(*checksumError); ok {
+		return "does not match its checksum"
+	}
+	return fmt.Sprintf("is unreadable: %s", err.Error())
+}
+
+// Replaces the node at the given level containing the given leaf with an empty one, so that its whole range reads as
+// zeros. The node itself is never read, so this also works for nodes which cannot be read
+func (s *ShortenBlock) discardNode(level int, leafIdx int) error {
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	node, err := s.nodeAt(level, leafIdx)
+	if err != nil {
+		return err
+	}
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	if level == s.depth {
+		s.nodeWrite(node, make([]byte, s.shortener.NodeSize()))
+		return nil
+	}
+	node.id = ""
+	node.hash = ""
+	node.children = nil
+	s.markDirty(node)
+	return nil
+}
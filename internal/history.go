@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"strings"
+	"time"
+)
+
+// A root ID the volume had at some point in time, along with its checksum if the volume has checksums. Since nodes are
+// immutable, every past root remains a complete and consistent snapshot of the volume as it was then
+type Snapshot struct {
+	Time     time.Time
+	RootID   string
+	RootHash string
+}
+
+// Appends a snapshot to the history file at the given path, creating it if needed
+func appendHistory(path string, snapshot Snapshot) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "could not open history")
+	}
+	root := snapshot.RootID
+	if snapshot.RootHash != "" {
+		root += ":" + snapshot.RootHash
+	}
+	if _, err = fmt.Fprintf(file, "%s %s\n", snapshot.Time.UTC().Format(time.RFC3339), root); err != nil {
+		_ = file.Close()
+		return errors.Wrap(err, "could not append to history")
+	}
+	return file.Close()
+}
+
+// Reads every snapshot recorded in the history file at the given path, oldest first. A missing file has no history
+func ReadHistory(path string) ([]Snapshot, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "could not open history")
+	}
+	defer file.Close()
+
+	var snapshots []Snapshot
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			log.Warnf("skipping malformed history entry %q", scanner.Text())
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, fields[0])
+		if err != nil {
+			log.Warnf("skipping malformed history entry %q", scanner.Text())
+			continue
+		}
+		snapshot := Snapshot{Time: t, RootID: fields[1]}
+		if idx := strings.Index(snapshot.RootID, ":"); idx >= 0 {
+			snapshot.RootID, snapshot.RootHash = snapshot.RootID[:idx], snapshot.RootID[idx+1:]
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "could not read history")
+	}
+	return snapshots, nil
+}
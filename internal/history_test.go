@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Snapshots must read back in the order they were appended, with their checksums, skipping any malformed entries
+func TestHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml.history")
+	if snapshots, err := ReadHistory(path); err != nil || len(snapshots) != 0 {
+		t.Fatalf("missing history read as %d snapshots, %v", len(snapshots), err)
+	}
+
+	zone := time.FixedZone("UTC+2", 2*60*60)
+	expected := []Snapshot{
+		{Time: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), RootID: "5m0pW4Fn"},
+		{Time: time.Date(2020, 1, 2, 3, 5, 0, 0, zone), RootID: "Jw444Bm0", RootHash: "NhYGWBKRBA4wSLraoTjJNQ"},
+	}
+	if err := appendHistory(path, expected[0]); err != nil {
+		t.Fatalf("could not append to history: %s", err.Error())
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("could not open history: %s", err.Error())
+	}
+	_, err = file.WriteString("not a snapshot\nyesterday 5m0pW4Fn\n")
+	_ = file.Close()
+	if err != nil {
+		t.Fatalf("could not write to history: %s", err.Error())
+	}
+	if err = appendHistory(path, expected[1]); err != nil {
+		t.Fatalf("could not append to history: %s", err.Error())
+	}
+
+	snapshots, err := ReadHistory(path)
+	if err != nil {
+		t.Fatalf("could not read history: %s", err.Error())
+	}
+	if len(snapshots) != len(expected) {
+		t.Fatalf("history holds %d snapshots rather than %d", len(snapshots), len(expected))
+	}
+	for i, snapshot := range snapshots {
+		if !snapshot.Time.Equal(expected[i].Time) || snapshot.RootID != expected[i].RootID ||
+			snapshot.RootHash != expected[i].RootHash {
+			t.Errorf("snapshot %d read back as %+v rather than %+v", i, snapshot, expected[i])
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/1ttric/shortenfs/internal/config"
+	"github.com/1ttric/shortenfs/internal/drivers"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// Creates a new volume holding the contents of a raw image file, or of stdin if the path is "-". Rather than writing
+// through the tree, which would rewrite every ancestor of each leaf, the tree is built bottom-up: each group of sibling
+// leaves is uploaded together, followed by their parent, so that every node is uploaded exactly once. Chunks which are
+// entirely zero are not uploaded at all. If no depth is configured, the smallest one fitting the image is used
+func Import(backend drivers.Driver, config config.ShortenBlockConfig, path string) (*ShortenBlock, error) {
+	var in io.Reader
+	size := 0
+	if path == "-" {
+		if config.Depth <= 0 {
+			return nil, fmt.Errorf("the size of stdin is unknown, so a depth is required")
+		}
+		in = os.Stdin
+	} else {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not open image")
+		}
+		defer file.Close()
+		stat, err := file.Stat()
+		if err != nil {
+			return nil, errors.Wrap(err, "could not open image")
+		}
+		in, size = file, int(stat.Size())
+	}
+	if size == 0 && config.Depth <= 0 {
+		return nil, fmt.Errorf("image is empty, so a depth is required")
+	}
+
+	s, err := createVolume(backend, config, size)
+	if err != nil {
+		return nil, err
+	}
+	if size > s.Capacity() {
+		_ = s.Close()
+		return nil, fmt.Errorf("image of %d bytes does not fit in a volume of %d bytes", size, s.Capacity())
+	}
+	if err = s.importTree(in, size); err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	if err = s.commitRoot(); err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Uploads the tree for an image, leaving its root as the root of the volume's tree
+func (s *ShortenBlock) importTree(in io.Reader, size int) error {
+	nodeSize := s.shortener.NodeSize()
+	capacity := s.Capacity()
+	builder := s.newTreeBuilder()
+	imported := 0
+	lastReport := time.Now()
+	for eof := false; !eof && imported < capacity; {
+		// Read the leaves sharing the next parent, all of which are uploaded together
+		var chunks [][]byte
+		for len(chunks) < s.idsPerNode {
+			chunk := make([]byte, nodeSize)
+			read, err := io.ReadFull(in, chunk)
+			if err == io.EOF {
+				eof = true
+				break
+			} else if err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return errors.Wrap(err, "could not read image")
+			}
+			chunks = append(chunks, chunk)
+			imported += read
+			if eof {
+				break
+			}
+		}
+		if err := builder.addLeaves(chunks); err != nil {
+			return err
+		}
+
+		if time.Since(lastReport) >= progressInterval {
+			lastReport = time.Now()
+			if size > 0 {
+				log.Infof("imported %d of %d bytes (%.1f%%)", imported, size, 100*float64(imported)/float64(size))
+			} else {
+				log.Infof("imported %d bytes", imported)
+			}
+		}
+	}
+	if imported == capacity {
+		// Anything beyond a full volume is ignored, but only if it is all zeros
+		extra, err := io.Copy(zeroChecker{}, in)
+		if err != nil {
+			return errors.Wrap(err, "image does not fit in the volume")
+		}
+		if extra > 0 {
+			log.Debugf("ignoring %d zero bytes beyond the end of the volume", extra)
+		}
+	}
+	if err := builder.finish(); err != nil {
+		return err
+	}
+	log.Infof("imported %d bytes", imported)
+	return nil
+}
+
+// Builds a tree bottom-up from its leaves, given in order, so that every node is uploaded exactly once. Leaves which
+// are skipped over are left empty, along with any subtrees containing only skipped leaves
+type treeBuilder struct {
+	s *ShortenBlock
+	// References to the children gathered so far for the node currently being built at each level of the tree
+	pending [][]childRef
+	// Index of the next leaf to be added
+	next int
+}
+
+func (s *ShortenBlock) newTreeBuilder() *treeBuilder {
+	return &treeBuilder{s: s, pending: make([][]childRef, s.depth)}
+}
+
+// Uploads the given leaves in parallel, then adds them to the tree at the next leaf indices. All-zero leaves are
+// never uploaded
+func (b *treeBuilder) addLeaves(leaves [][]byte) error {
+	refs := make([]childRef, len(leaves))
+	err := b.s.parallel(len(leaves), func(i int) error {
+		if allZero(leaves[i]) {
+			return nil
+		}
+		id, err := b.s.dedupWrite(leaves[i])
+		refs[i] = b.s.newRef(id, leaves[i])
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if err = b.addChild(b.s.depth-1, ref); err != nil {
+			return err
+		}
+		b.next++
+	}
+	return nil
+}
+
+// Leaves every leaf before the given index empty
+func (b *treeBuilder) skipTo(leafIdx int) error {
+	for b.next < leafIdx {
+		// Skip the largest subtree which starts at the next leaf and ends before the given one. Its parent is
+		// necessarily the node currently being built at its level, as every level below it is empty
+		span := 1
+		for level := 0; level < b.s.depth; level++ {
+			span = int(math.Pow(float64(b.s.idsPerNode), float64(b.s.depth-level-1)))
+			if b.next%span == 0 && b.next+span <= leafIdx {
+				if err := b.addChild(level, childRef{}); err != nil {
+					return err
+				}
+				break
+			}
+		}
+		b.next += span
+	}
+	return nil
+}
+
+// Completes the tree, leaving any remaining leaves empty, and makes it the volume's tree
+func (b *treeBuilder) finish() error {
+	return b.skipTo(int(math.Pow(float64(b.s.idsPerNode), float64(b.s.depth))))
+}
+
+// Adds a child to the node being built at the given level, uploading the node once it is full
+func (b *treeBuilder) addChild(level int, ref childRef) error {
+	b.pending[level] = append(b.pending[level], ref)
+	if len(b.pending[level]) < b.s.idsPerNode {
+		return nil
+	}
+	ref, err := b.s.uploadInterior(b.pending[level])
+	if err != nil {
+		return err
+	}
+	b.pending[level] = nil
+	if level == 0 {
+		b.s.tree = &Node{id: ref.id, hash: ref.hash}
+		return nil
+	}
+	return b.addChild(level-1, ref)
+}
+
+// Uploads an interior node with the given children, unless every child is empty
+func (s *ShortenBlock) uploadInterior(children []childRef) (childRef, error) {
+	for _, child := range children {
+		if child.id != "" {
+			data := formatChildren(children)
+			id, err := s.dedupWrite(data)
+			return s.newRef(id, data), err
+		}
+	}
+	return childRef{}, nil
+}
+
+// Discards writes of zero bytes, failing on anything else
+type zeroChecker struct{}
+
+func (zeroChecker) Write(data []byte) (int, error) {
+	if !allZero(data) {
+		return 0, fmt.Errorf("non-zero data found")
+	}
+	return len(data), nil
+}
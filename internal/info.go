@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"github.com/1ttric/shortenfs/internal/config"
+	"github.com/1ttric/shortenfs/internal/drivers"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// Describes the geometry of a volume and how much of it is populated, as found by walking its entire node tree
+type VolumeInfo struct {
+	RootID      string `json:"rootid"`
+	RootHash    string `json:"roothash"`
+	TreeRoot    string `json:"treeroot"`
+	Driver      string `json:"driver"`
+	Version     int    `json:"version"`
+	Depth       int    `json:"depth"`
+	IdsPerNode  int    `json:"idspernode"`
+	NodeSize    int    `json:"nodesize"`
+	Capacity    int    `json:"capacity"`
+	Compression string `json:"compression"`
+	Encryption  string `json:"encryption"`
+	Checksum    string `json:"checksum"`
+	// Leaves which have been written, and leaves which are implicitly all zeros
+	AllocatedLeaves int `json:"allocatedleaves"`
+	SparseLeaves    int `json:"sparseleaves"`
+	// Distinct interior nodes and leaves stored in the shortener. Nodes shared by several parts of the tree, such as
+	// deduplicated ones, are only counted once
+	InteriorNodes int `json:"interiornodes"`
+	StoredLeaves  int `json:"storedleaves"`
+	// Bytes held in shortlinks, as stored by the backend, including the superblock
+	StoredBytes int64 `json:"storedbytes"`
+	// Requests made to the shortener to gather this information
+	Requests int64 `json:"requests"`
+}
+
+// Wraps a driver to count the requests made through it, and the bytes they returned
+type countingDriver struct {
+	drivers.Driver
+	requests int64
+	bytes    int64
+}
+
+func (c *countingDriver) Read(id string) ([]byte, error) {
+	atomic.AddInt64(&c.requests, 1)
+	data, err := c.Driver.Read(id)
+	atomic.AddInt64(&c.bytes, int64(len(data)))
+	return data, err
+}
+
+func (c *countingDriver) ReadVerified(id string, check func(data []byte) error) ([]byte, error) {
+	atomic.AddInt64(&c.requests, 1)
+	data, err := drivers.ReadVerified(c.Driver, id, check)
+	atomic.AddInt64(&c.bytes, int64(len(data)))
+	return data, err
+}
+
+func (c *countingDriver) Write(data []byte) (string, error) {
+	atomic.AddInt64(&c.requests, 1)
+	return c.Driver.Write(data)
+}
+
+// Opens the configured volume read-only and walks every node of its tree, fetching each distinct node once from the
+// shortener rather than the node cache
+func Inspect(backend drivers.Driver, config config.ShortenBlockConfig) (*VolumeInfo, error) {
+	config.CacheDir = ""
+	counter := &countingDriver{Driver: backend}
+	s, err := OpenReadOnly(counter, config)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	info := &VolumeInfo{
+		RootID:      s.GetRootID(),
+		RootHash:    s.GetRootHash(),
+		TreeRoot:    s.tree.id,
+		Driver:      s.volume.Driver,
+		Version:     s.volume.Version,
+		Depth:       s.depth,
+		IdsPerNode:  s.idsPerNode,
+		NodeSize:    s.shortener.NodeSize(),
+		Capacity:    s.Capacity(),
+		Compression: s.volume.Compression,
+		Encryption:  s.volume.Encryption,
+		Checksum:    s.volume.Checksum,
+	}
+	w := &treeWalker{s: s, seen: make(map[string]*walkResult)}
+	if info.AllocatedLeaves, err = w.walk(childRef{id: s.tree.id, hash: s.tree.hash}, 0, 0); err != nil {
+		return nil, err
+	}
+	info.SparseLeaves = int(math.Pow(float64(s.idsPerNode), float64(s.depth))) - info.AllocatedLeaves
+	info.InteriorNodes = w.interiorNodes
+	info.StoredLeaves = w.storedLeaves
+	info.StoredBytes = atomic.LoadInt64(&counter.bytes)
+	info.Requests = atomic.LoadInt64(&counter.requests)
+	return info, nil
+}
+
+// Counts the leaves beneath each node of a tree, fetching each distinct node ID only once
+type treeWalker struct {
+	s             *ShortenBlock
+	lock          sync.Mutex
+	seen          map[string]*walkResult
+	interiorNodes int
+	storedLeaves  int
+}
+
+// Number of allocated leaves beneath a node, available once done is closed
+type walkResult struct {
+	done   chan struct{}
+	leaves int
+	err    error
+}
+
+// Returns the number of allocated leaves beneath the given node, at the given level of the tree and containing the given
+// leaf. Each node is verified against its checksum when it is first fetched
+func (w *treeWalker) walk(ref childRef, level int, firstLeaf int) (int, error) {
+	if ref.id == "" {
+		return 0, nil
+	}
+	w.lock.Lock()
+	result, ok := w.seen[ref.id]
+	if ok {
+		w.lock.Unlock()
+		<-result.done
+		return result.leaves, result.err
+	}
+	result = &walkResult{done: make(chan struct{})}
+	w.seen[ref.id] = result
+	if level == w.s.depth {
+		w.storedLeaves++
+	} else {
+		w.interiorNodes++
+	}
+	w.lock.Unlock()
+	defer close(result.done)
+
+	data, err := w.s.verifiedRead(ref, level, firstLeaf)
+	if err != nil {
+		result.err = err
+		return 0, err
+	}
+	if level == w.s.depth {
+		result.leaves = 1
+		return 1, nil
+	}
+	children := parseChildren(data)
+	childSpan := int(math.Pow(float64(w.s.idsPerNode), float64(w.s.depth-level-1)))
+	counts := make([]int, len(children))
+	result.err = w.s.parallel(len(children), func(i int) error {
+		var err error
+		counts[i], err = w.walk(children[i], level+1, firstLeaf+i*childSpan)
+		return err
+	})
+	for _, count := range counts {
+		result.leaves += count
+	}
+	return result.leaves, result.err
+}
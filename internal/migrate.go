@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/1ttric/shortenfs/internal/config"
+	"github.com/1ttric/shortenfs/internal/drivers"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// Copies a volume into a new volume, which may use a different driver and therefore a different node size, ID size
+// and depth. Only the written parts of the source are read, and the new volume is built bottom-up as for an import.
+// Once built, the new volume is read back and compared against the source in full
+func Migrate(source drivers.Driver, sourceConfig config.ShortenBlockConfig, target drivers.Driver,
+	targetConfig config.ShortenBlockConfig) (*ShortenBlock, error) {
+	src, err := OpenReadOnly(source, sourceConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	dst, err := createVolume(target, targetConfig, src.Capacity())
+	if err != nil {
+		return nil, err
+	}
+	if dst.Capacity() < src.Capacity() {
+		_ = dst.Close()
+		return nil, fmt.Errorf("target volume of %d bytes is smaller than the source volume of %d bytes",
+			dst.Capacity(), src.Capacity())
+	}
+	log.Infof("migrating %d bytes from depth %d with %d byte nodes to depth %d with %d byte nodes", src.Capacity(),
+		src.depth, src.shortener.NodeSize(), dst.depth, dst.shortener.NodeSize())
+
+	if err = dst.copyFrom(src); err != nil {
+		_ = dst.Close()
+		return nil, err
+	}
+	if err = dst.commitRoot(); err != nil {
+		_ = dst.Close()
+		return nil, err
+	}
+
+	// Verify the result as stored, rather than as held in memory or in the node cache, which every node written was
+	// added to
+	targetConfig.RootID = dst.GetRootID()
+	targetConfig.RootHash = dst.GetRootHash()
+	targetConfig.Depth = dst.depth
+	targetConfig.CacheDir = ""
+	check, err := OpenReadOnly(target, targetConfig)
+	if err != nil {
+		_ = dst.Close()
+		return nil, err
+	}
+	defer check.Close()
+	log.Infof("verifying volume %s against the source", targetConfig.RootID)
+	if err = compareVolumes(src, check); err == nil {
+		err = compareVolumes(check, src)
+	}
+	if err != nil {
+		_ = dst.Close()
+		return nil, fmt.Errorf("new volume %s does not match the source: %s", targetConfig.RootID, err.Error())
+	}
+	return dst, nil
+}
+
+// Builds this volume's tree from the written leaves of another volume, re-chunking them into this volume's node size
+func (s *ShortenBlock) copyFrom(src *ShortenBlock) error {
+	nodeSize := s.shortener.NodeSize()
+	builder := s.newTreeBuilder()
+	// Consecutive target leaves waiting to be uploaded together, starting at batchStart
+	var batch [][]byte
+	batchStart := 0
+	flushBatch := func() error {
+		err := builder.addLeaves(batch)
+		batch = nil
+		return err
+	}
+	addLeaf := func(leafIdx int, data []byte) error {
+		if len(batch) > 0 && (leafIdx != batchStart+len(batch) || len(batch) == s.idsPerNode) {
+			if err := flushBatch(); err != nil {
+				return err
+			}
+		}
+		if len(batch) == 0 {
+			if err := builder.skipTo(leafIdx); err != nil {
+				return err
+			}
+			batchStart = leafIdx
+		}
+		batch = append(batch, data)
+		return nil
+	}
+
+	// The target leaf currently being filled from the source
+	current, currentIdx := []byte(nil), -1
+	copied := 0
+	lastReport := time.Now()
+	err := src.walkLeaves(0, func(firstLeaf int, refs []childRef) error {
+		leaves, err := src.fetchLeaves(firstLeaf, refs)
+		if err != nil {
+			return err
+		}
+		for i, leaf := range leaves {
+			offset := (firstLeaf + i) * src.shortener.NodeSize()
+			for pos := 0; pos < len(leaf); {
+				leafIdx := (offset + pos) / nodeSize
+				if leafIdx != currentIdx {
+					if current != nil {
+						if err = addLeaf(currentIdx, current); err != nil {
+							return err
+						}
+					}
+					current, currentIdx = make([]byte, nodeSize), leafIdx
+				}
+				n := copy(current[(offset+pos)%nodeSize:], leaf[pos:])
+				pos += n
+			}
+			copied += len(leaf)
+		}
+		if time.Since(lastReport) >= progressInterval {
+			lastReport = time.Now()
+			position := (firstLeaf + len(refs)) * src.shortener.NodeSize()
+			log.Infof("migrated %d bytes, up to %d of %d (%.1f%%)", copied, position, src.Capacity(),
+				100*float64(position)/float64(src.Capacity()))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if current != nil {
+		if err = addLeaf(currentIdx, current); err != nil {
+			return err
+		}
+	}
+	if len(batch) > 0 {
+		if err = flushBatch(); err != nil {
+			return err
+		}
+	}
+	log.Infof("migrated %d bytes", copied)
+	return builder.finish()
+}
+
+// Checks that every written leaf of one volume reads back identically from another. Leaves beyond the end of the
+// other volume must be all zeros
+func compareVolumes(a *ShortenBlock, b *ShortenBlock) error {
+	return a.walkLeaves(0, func(firstLeaf int, refs []childRef) error {
+		leaves, err := a.fetchLeaves(firstLeaf, refs)
+		if err != nil {
+			return err
+		}
+		for i, leaf := range leaves {
+			offset := (firstLeaf + i) * a.shortener.NodeSize()
+			inRange := len(leaf)
+			if offset+inRange > b.Capacity() {
+				inRange = b.Capacity() - offset
+				if inRange < 0 {
+					inRange = 0
+				}
+				if !allZero(leaf[inRange:]) {
+					return fmt.Errorf("data at byte %d lies beyond the end of the volume", offset+inRange)
+				}
+			}
+			if inRange == 0 {
+				continue
+			}
+			other, err := b.Read(inRange, offset)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(leaf[:inRange], other) {
+				return fmt.Errorf("bytes %d to %d differ", offset, offset+inRange)
+			}
+		}
+		return nil
+	})
+}
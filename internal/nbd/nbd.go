@@ -0,0 +1,364 @@
+// Package nbd implements the server side of the Network Block Device protocol, using the fixed newstyle handshake and
+// simple replies. It supports the read, write, flush and trim commands, which is enough for the Linux nbd-client.
+package nbd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+)
+
+const (
+	nbdMagic         uint64 = 0x4e42444d41474943 // "NBDMAGIC"
+	optMagic         uint64 = 0x49484156454f5054 // "IHAVEOPT"
+	optReplyMagic    uint64 = 0x3e889045565a9
+	requestMagic     uint32 = 0x25609513
+	simpleReplyMagic uint32 = 0x67446698
+
+	flagFixedNewstyle uint16 = 1 << 0
+	flagNoZeroes      uint16 = 1 << 1
+
+	optExportName uint32 = 1
+	optAbort      uint32 = 2
+	optList       uint32 = 3
+	optInfo       uint32 = 6
+	optGo         uint32 = 7
+
+	repAck        uint32 = 1
+	repServer     uint32 = 2
+	repInfo       uint32 = 3
+	repErrUnsup   uint32 = 1<<31 + 1
+	repErrInvalid uint32 = 1<<31 + 3
+	repErrUnknown uint32 = 1<<31 + 6
+
+	infoExport uint16 = 0
+
+	transHasFlags  uint16 = 1 << 0
+	transReadOnly  uint16 = 1 << 1
+	transSendFlush uint16 = 1 << 2
+	transSendFua   uint16 = 1 << 3
+	transSendTrim  uint16 = 1 << 5
+
+	cmdRead    uint16 = 0
+	cmdWrite   uint16 = 1
+	cmdDisc    uint16 = 2
+	cmdFlush   uint16 = 3
+	cmdTrim    uint16 = 4
+	cmdFlagFua uint16 = 1 << 0
+
+	errPerm  uint32 = 1
+	errIO    uint32 = 5
+	errInval uint32 = 22
+	errNoSpc uint32 = 28
+
+	// Reads and writes larger than this are refused rather than buffered, as the kernel never sends them. Trims carry
+	// no payload and may cover the whole device, so they are instead passed to the device this much at a time
+	maxRequestSize = 32 << 20
+)
+
+// The block device being exported. Requests beyond its end fail with syscall.ENOSPC, or syscall.EINVAL for reads,
+// and reads extending past its end are cut short
+type Device interface {
+	Capacity() int
+	Read(size int, offset int) ([]byte, error)
+	Write(offset int, data []byte) (int, error)
+	Flush() error
+	Discard(offset int, size int) error
+}
+
+type Server struct {
+	Device Device
+	// Name of the single export offered. Clients may request it by name, or by the empty default name
+	ExportName string
+	ReadOnly   bool
+}
+
+// Accepts and serves connections until the listener is closed
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			log.Infof("nbd client connected from %s", conn.RemoteAddr())
+			if err := s.ServeConn(conn); err != nil {
+				log.Errorf("nbd connection failed: %s", err.Error())
+			}
+			log.Infof("nbd client from %s disconnected", conn.RemoteAddr())
+		}()
+	}
+}
+
+// Performs the handshake on a single connection, then serves its requests until it disconnects
+func (s *Server) ServeConn(conn io.ReadWriter) error {
+	ok, err := s.handshake(conn)
+	if err != nil || !ok {
+		return err
+	}
+	return s.transmit(conn)
+}
+
+func (s *Server) transmissionFlags() uint16 {
+	flags := transHasFlags | transSendFlush | transSendFua | transSendTrim
+	if s.ReadOnly {
+		flags |= transReadOnly
+	}
+	return flags
+}
+
+// Negotiates options with the client, returning true once it is ready to move to the transmission phase
+func (s *Server) handshake(conn io.ReadWriter) (bool, error) {
+	if err := binary.Write(conn, binary.BigEndian, struct {
+		Magic    uint64
+		OptMagic uint64
+		Flags    uint16
+	}{nbdMagic, optMagic, flagFixedNewstyle | flagNoZeroes}); err != nil {
+		return false, errors.Wrap(err, "could not send greeting")
+	}
+	var clientFlags uint32
+	if err := binary.Read(conn, binary.BigEndian, &clientFlags); err != nil {
+		return false, errors.Wrap(err, "could not read client flags")
+	}
+	noZeroes := clientFlags&uint32(flagNoZeroes) != 0
+
+	for {
+		var opt struct {
+			Magic  uint64
+			Option uint32
+			Length uint32
+		}
+		if err := binary.Read(conn, binary.BigEndian, &opt); err != nil {
+			return false, errors.Wrap(err, "could not read option")
+		}
+		if opt.Magic != optMagic {
+			return false, fmt.Errorf("bad option magic %x", opt.Magic)
+		}
+		if opt.Length > 4096 {
+			return false, fmt.Errorf("option of %d bytes is too long", opt.Length)
+		}
+		data := make([]byte, opt.Length)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return false, errors.Wrap(err, "could not read option data")
+		}
+		log.Debugf("nbd option %d with %d bytes", opt.Option, opt.Length)
+
+		switch opt.Option {
+		case optExportName:
+			if !s.knownExport(string(data)) {
+				return false, fmt.Errorf("client requested unknown export %q", data)
+			}
+			if err := binary.Write(conn, binary.BigEndian, struct {
+				Size  uint64
+				Flags uint16
+			}{uint64(s.Device.Capacity()), s.transmissionFlags()}); err != nil {
+				return false, err
+			}
+			if !noZeroes {
+				if _, err := conn.Write(make([]byte, 124)); err != nil {
+					return false, err
+				}
+			}
+			return true, nil
+
+		case optAbort:
+			return false, s.optReply(conn, opt.Option, repAck, nil)
+
+		case optList:
+			name := []byte(s.ExportName)
+			reply := make([]byte, 4+len(name))
+			binary.BigEndian.PutUint32(reply, uint32(len(name)))
+			copy(reply[4:], name)
+			if err := s.optReply(conn, opt.Option, repServer, reply); err != nil {
+				return false, err
+			}
+			if err := s.optReply(conn, opt.Option, repAck, nil); err != nil {
+				return false, err
+			}
+
+		case optInfo, optGo:
+			if len(data) < 4 || int(binary.BigEndian.Uint32(data)) > len(data)-6 {
+				if err := s.optReply(conn, opt.Option, repErrInvalid, nil); err != nil {
+					return false, err
+				}
+				continue
+			}
+			name := string(data[4 : 4+binary.BigEndian.Uint32(data)])
+			if !s.knownExport(name) {
+				if err := s.optReply(conn, opt.Option, repErrUnknown, nil); err != nil {
+					return false, err
+				}
+				continue
+			}
+			info := make([]byte, 12)
+			binary.BigEndian.PutUint16(info, infoExport)
+			binary.BigEndian.PutUint64(info[2:], uint64(s.Device.Capacity()))
+			binary.BigEndian.PutUint16(info[10:], s.transmissionFlags())
+			if err := s.optReply(conn, opt.Option, repInfo, info); err != nil {
+				return false, err
+			}
+			if err := s.optReply(conn, opt.Option, repAck, nil); err != nil {
+				return false, err
+			}
+			if opt.Option == optGo {
+				return true, nil
+			}
+
+		default:
+			if err := s.optReply(conn, opt.Option, repErrUnsup, nil); err != nil {
+				return false, err
+			}
+		}
+	}
+}
+
+func (s *Server) knownExport(name string) bool {
+	return name == "" || name == s.ExportName
+}
+
+func (s *Server) optReply(conn io.Writer, option uint32, replyType uint32, data []byte) error {
+	if err := binary.Write(conn, binary.BigEndian, struct {
+		Magic  uint64
+		Option uint32
+		Type   uint32
+		Length uint32
+	}{optReplyMagic, option, replyType, uint32(len(data))}); err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	_, err := conn.Write(data)
+	return err
+}
+
+type request struct {
+	Magic  uint32
+	Flags  uint16
+	Type   uint16
+	Handle uint64
+	Offset uint64
+	Length uint32
+}
+
+// Serves requests until the client disconnects. Requests are handled concurrently, so replies are sent in whichever
+// order they complete, as the protocol allows
+func (s *Server) transmit(conn io.ReadWriter) error {
+	var replyLock sync.Mutex
+	var inFlight sync.WaitGroup
+	defer inFlight.Wait()
+
+	reply := func(handle uint64, errno uint32, data []byte) {
+		replyLock.Lock()
+		defer replyLock.Unlock()
+		if err := binary.Write(conn, binary.BigEndian, struct {
+			Magic  uint32
+			Error  uint32
+			Handle uint64
+		}{simpleReplyMagic, errno, handle}); err != nil {
+			log.Errorf("could not send nbd reply: %s", err.Error())
+			return
+		}
+		if len(data) == 0 {
+			return
+		}
+		if _, err := conn.Write(data); err != nil {
+			log.Errorf("could not send nbd reply: %s", err.Error())
+		}
+	}
+
+	for {
+		var req request
+		if err := binary.Read(conn, binary.BigEndian, &req); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errors.Wrap(err, "could not read request")
+		}
+		if req.Magic != requestMagic {
+			return fmt.Errorf("bad request magic %x", req.Magic)
+		}
+		if (req.Type == cmdRead || req.Type == cmdWrite) && req.Length > maxRequestSize {
+			return fmt.Errorf("request of %d bytes is too large", req.Length)
+		}
+
+		var data []byte
+		if req.Type == cmdWrite {
+			data = make([]byte, req.Length)
+			if _, err := io.ReadFull(conn, data); err != nil {
+				return errors.Wrap(err, "could not read write data")
+			}
+		}
+		if req.Type == cmdDisc {
+			log.Debugf("nbd client requested disconnect")
+			inFlight.Wait()
+			return s.Device.Flush()
+		}
+		inFlight.Add(1)
+		go func(req request, data []byte) {
+			defer inFlight.Done()
+			errno, readData := s.handle(req, data)
+			reply(req.Handle, errno, readData)
+		}(req, data)
+	}
+}
+
+// Performs a single request, returning an errno and any data read
+func (s *Server) handle(req request, data []byte) (uint32, []byte) {
+	log.Tracef("nbd command %d at %d of %d bytes", req.Type, req.Offset, req.Length)
+	var err error
+	switch req.Type {
+	case cmdRead:
+		var readData []byte
+		if readData, err = s.Device.Read(int(req.Length), int(req.Offset)); err == nil {
+			if len(readData) < int(req.Length) {
+				// The device cuts reads short at its end
+				return errInval, nil
+			}
+			return 0, readData
+		}
+	case cmdWrite:
+		if s.ReadOnly {
+			return errPerm, nil
+		}
+		if _, err = s.Device.Write(int(req.Offset), data); err == nil && req.Flags&cmdFlagFua != 0 {
+			err = s.Device.Flush()
+		}
+	case cmdFlush:
+		err = s.Device.Flush()
+	case cmdTrim:
+		if s.ReadOnly {
+			return errPerm, nil
+		}
+		// Other requests get a turn between chunks, rather than waiting out the whole trim. Chunks end on multiples of
+		// their size, so that they split as few leaves as possible
+		for offset, remaining := int(req.Offset), int(req.Length); remaining > 0 && err == nil; {
+			n := maxRequestSize - offset%maxRequestSize
+			if n > remaining {
+				n = remaining
+			}
+			err = s.Device.Discard(offset, n)
+			offset += n
+			remaining -= n
+		}
+	default:
+		return errInval, nil
+	}
+	switch err {
+	case nil:
+		return 0, nil
+	case syscall.EINVAL:
+		return errInval, nil
+	case syscall.ENOSPC:
+		log.Debugf("nbd command %d at %d of %d bytes is out of range", req.Type, req.Offset, req.Length)
+		return errNoSpc, nil
+	}
+	log.Errorf("nbd command %d at %d failed: %s", req.Type, req.Offset, err.Error())
+	return errIO, nil
+}
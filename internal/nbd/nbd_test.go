@@ -0,0 +1,303 @@
+package nbd_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/1ttric/shortenfs/internal"
+	"github.com/1ttric/shortenfs/internal/config"
+	"github.com/1ttric/shortenfs/internal/drivers/memory"
+	"github.com/1ttric/shortenfs/internal/nbd"
+	"math"
+	"net"
+	"testing"
+)
+
+const (
+	nbdMagic         uint64 = 0x4e42444d41474943
+	optMagic         uint64 = 0x49484156454f5054
+	optReplyMagic    uint64 = 0x3e889045565a9
+	requestMagic     uint32 = 0x25609513
+	simpleReplyMagic uint32 = 0x67446698
+
+	optExportName uint32 = 1
+	optGo         uint32 = 7
+	repAck        uint32 = 1
+	repInfo       uint32 = 3
+
+	cmdRead  uint16 = 0
+	cmdWrite uint16 = 1
+	cmdDisc  uint16 = 2
+	cmdFlush uint16 = 3
+	cmdTrim  uint16 = 4
+
+	errPerm  uint32 = 1
+	errInval uint32 = 22
+	errNoSpc uint32 = 28
+)
+
+type client struct {
+	t      *testing.T
+	conn   net.Conn
+	served chan error
+	handle uint64
+}
+
+// Serves a fresh volume on the memory driver over a pipe, returning it along with a client which has not yet begun
+// the handshake
+func serve(t *testing.T, readOnly bool) (*internal.ShortenBlock, *client) {
+	block := internal.NewShortenBlock(&memory.Memory{}, config.ShortenBlockConfig{Driver: "memory", Depth: 2})
+	server := &nbd.Server{Device: block, ExportName: "shortenfs", ReadOnly: readOnly}
+	serverConn, clientConn := net.Pipe()
+	c := &client{t: t, conn: clientConn, served: make(chan error, 1)}
+	go func() {
+		c.served <- server.ServeConn(serverConn)
+		_ = serverConn.Close()
+	}()
+	t.Cleanup(func() {
+		_ = clientConn.Close()
+	})
+	return block, c
+}
+
+func (c *client) send(values ...interface{}) {
+	for _, value := range values {
+		// Empty writes to a pipe block until the other end reads, which the server never does for empty data
+		if data, ok := value.([]byte); ok && len(data) == 0 {
+			continue
+		}
+		if err := binary.Write(c.conn, binary.BigEndian, value); err != nil {
+			c.t.Fatalf("could not send to server: %s", err.Error())
+		}
+	}
+}
+
+func (c *client) receive(values ...interface{}) {
+	for _, value := range values {
+		if err := binary.Read(c.conn, binary.BigEndian, value); err != nil {
+			c.t.Fatalf("could not receive from server: %s", err.Error())
+		}
+	}
+}
+
+// Reads the server greeting and sends the client flags, asking for the zero padding to be left out
+func (c *client) greet() {
+	var greeting struct {
+		Magic    uint64
+		OptMagic uint64
+		Flags    uint16
+	}
+	c.receive(&greeting)
+	if greeting.Magic != nbdMagic || greeting.OptMagic != optMagic {
+		c.t.Fatalf("bad greeting %+v", greeting)
+	}
+	c.send(uint32(1<<0 | 1<<1))
+}
+
+// Negotiates with the EXPORT_NAME option, returning the export size
+func (c *client) exportName(name string) uint64 {
+	c.greet()
+	c.send(optMagic, optExportName, uint32(len(name)), []byte(name))
+	var export struct {
+		Size  uint64
+		Flags uint16
+	}
+	c.receive(&export)
+	return export.Size
+}
+
+// Negotiates with the GO option, returning the export size
+func (c *client) optGo(name string) uint64 {
+	c.greet()
+	c.send(optMagic, optGo, uint32(4+len(name)+2), uint32(len(name)), []byte(name), uint16(0))
+	var size uint64
+	for {
+		var reply struct {
+			Magic  uint64
+			Option uint32
+			Type   uint32
+			Length uint32
+		}
+		c.receive(&reply)
+		if reply.Magic != optReplyMagic || reply.Option != optGo {
+			c.t.Fatalf("bad option reply %+v", reply)
+		}
+		data := make([]byte, reply.Length)
+		c.receive(data)
+		switch reply.Type {
+		case repInfo:
+			size = binary.BigEndian.Uint64(data[2:])
+		case repAck:
+			return size
+		default:
+			c.t.Fatalf("option failed with reply type %x", reply.Type)
+		}
+	}
+}
+
+// Sends a request and waits for its reply, returning the errno and any data read
+func (c *client) request(command uint16, offset uint64, length uint32, data []byte) (uint32, []byte) {
+	c.handle++
+	c.send(requestMagic, uint16(0), command, c.handle, offset, length)
+	if command == cmdWrite {
+		c.send(data)
+	}
+	var reply struct {
+		Magic  uint32
+		Error  uint32
+		Handle uint64
+	}
+	c.receive(&reply)
+	if reply.Magic != simpleReplyMagic || reply.Handle != c.handle {
+		c.t.Fatalf("bad reply %+v to request %d", reply, c.handle)
+	}
+	if command != cmdRead || reply.Error != 0 {
+		return reply.Error, nil
+	}
+	read := make([]byte, length)
+	c.receive(read)
+	return reply.Error, read
+}
+
+// Disconnects, and returns the server's result once it has finished
+func (c *client) disconnect() error {
+	c.send(requestMagic, uint16(0), cmdDisc, uint64(0), uint64(0), uint32(0))
+	return <-c.served
+}
+
+func TestHandshake(t *testing.T) {
+	block, c := serve(t, false)
+	if size := c.exportName("shortenfs"); size != uint64(block.Capacity()) {
+		t.Errorf("EXPORT_NAME reported a size of %d rather than %d", size, block.Capacity())
+	}
+	if err := c.disconnect(); err != nil {
+		t.Errorf("server failed: %s", err.Error())
+	}
+
+	block, c = serve(t, false)
+	if size := c.optGo(""); size != uint64(block.Capacity()) {
+		t.Errorf("GO reported a size of %d rather than %d", size, block.Capacity())
+	}
+	if err := c.disconnect(); err != nil {
+		t.Errorf("server failed: %s", err.Error())
+	}
+}
+
+func TestTransmission(t *testing.T) {
+	block, c := serve(t, false)
+	c.optGo("shortenfs")
+	data := bytes.Repeat([]byte("shortenfs"), 3000)
+	offset := uint64(12345)
+	if errno, _ := c.request(cmdWrite, offset, uint32(len(data)), data); errno != 0 {
+		t.Fatalf("write failed with errno %d", errno)
+	}
+	if errno, _ := c.request(cmdFlush, 0, 0, nil); errno != 0 {
+		t.Fatalf("flush failed with errno %d", errno)
+	}
+	if errno, read := c.request(cmdRead, offset, uint32(len(data)), nil); errno != 0 || !bytes.Equal(read, data) {
+		t.Fatalf("read failed with errno %d, or did not return what was written", errno)
+	}
+
+	// Only the trimmed part reads as zeros, even where it ends partway through a leaf
+	if errno, _ := c.request(cmdTrim, offset+100, uint32(len(data)-200), nil); errno != 0 {
+		t.Fatalf("trim failed with errno %d", errno)
+	}
+	expected := append(append(append([]byte{}, data[:100]...), make([]byte, len(data)-200)...), data[len(data)-100:]...)
+	if errno, read := c.request(cmdRead, offset, uint32(len(data)), nil); errno != 0 || !bytes.Equal(read, expected) {
+		t.Fatalf("read after trim failed with errno %d, or did not return zeros", errno)
+	}
+	if err := c.disconnect(); err != nil {
+		t.Fatalf("server failed: %s", err.Error())
+	}
+	if root := block.GetRootID(); root == "" {
+		t.Errorf("disconnect did not flush")
+	}
+}
+
+// Trims larger than any read or write must be carried out rather than refused, up to the whole device
+func TestLargeTrim(t *testing.T) {
+	block, c := serve(t, false)
+	c.optGo("shortenfs")
+	capacity := uint64(block.Capacity())
+	data := bytes.Repeat([]byte{0xff}, 8192)
+	for _, offset := range []uint64{0, 40 << 20, capacity - uint64(len(data))} {
+		if errno, _ := c.request(cmdWrite, offset, uint32(len(data)), data); errno != 0 {
+			t.Fatalf("write at %d failed with errno %d", offset, errno)
+		}
+	}
+
+	if errno, _ := c.request(cmdTrim, 1000, 64<<20, nil); errno != 0 {
+		t.Fatalf("64 MB trim failed with errno %d", errno)
+	}
+	if errno, read := c.request(cmdRead, 0, uint32(len(data)), nil); errno != 0 ||
+		!bytes.Equal(read, append(data[:1000:1000], make([]byte, len(data)-1000)...)) {
+		t.Errorf("64 MB trim did not zero the start of its range (errno %d)", errno)
+	}
+	if errno, read := c.request(cmdRead, 40<<20, uint32(len(data)), nil); errno != 0 ||
+		!bytes.Equal(read, make([]byte, len(data))) {
+		t.Errorf("64 MB trim did not zero the middle of its range (errno %d)", errno)
+	}
+
+	if errno, _ := c.request(cmdTrim, 0, uint32(capacity), nil); errno != 0 {
+		t.Fatalf("whole device trim failed with errno %d", errno)
+	}
+	if errno, _ := c.request(cmdFlush, 0, 0, nil); errno != 0 {
+		t.Fatalf("flush failed with errno %d", errno)
+	}
+	if errno, read := c.request(cmdRead, capacity-uint64(len(data)), uint32(len(data)), nil); errno != 0 ||
+		!bytes.Equal(read, make([]byte, len(data))) {
+		t.Errorf("whole device trim did not zero the end of the device (errno %d)", errno)
+	}
+	if err := c.disconnect(); err != nil {
+		t.Errorf("server failed: %s", err.Error())
+	}
+}
+
+// Requests beyond the end of the device are refused, and the server carries on serving the connection
+func TestOutOfRange(t *testing.T) {
+	block, c := serve(t, false)
+	c.optGo("shortenfs")
+	capacity := uint64(block.Capacity())
+	requests := []struct {
+		name    string
+		command uint16
+		offset  uint64
+		length  uint32
+		errno   uint32
+	}{
+		{"read past the end", cmdRead, capacity - 10, 20, errInval},
+		{"read after the end", cmdRead, capacity + 4096, 1, errInval},
+		{"read wrapping around", cmdRead, math.MaxUint64 - 10, 20, errInval},
+		{"write past the end", cmdWrite, capacity - 10, 20, errNoSpc},
+		{"write wrapping around", cmdWrite, math.MaxUint64 - 10, 20, errNoSpc},
+		{"trim past the end", cmdTrim, capacity - 10, 20, errNoSpc},
+		{"trim wrapping around", cmdTrim, math.MaxUint64 - 10, 20, errNoSpc},
+	}
+	for _, req := range requests {
+		if errno, _ := c.request(req.command, req.offset, req.length, make([]byte, req.length)); errno != req.errno {
+			t.Errorf("%s replied with errno %d rather than %d", req.name, errno, req.errno)
+		}
+	}
+	if errno, _ := c.request(cmdRead, capacity-10, 10, nil); errno != 0 {
+		t.Errorf("read at the end of the device failed with errno %d", errno)
+	}
+	if err := c.disconnect(); err != nil {
+		t.Errorf("server failed: %s", err.Error())
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	_, c := serve(t, true)
+	c.exportName("")
+	if errno, _ := c.request(cmdWrite, 0, 4, []byte("data")); errno != errPerm {
+		t.Errorf("write replied with errno %d rather than %d", errno, errPerm)
+	}
+	if errno, _ := c.request(cmdTrim, 0, 4, nil); errno != errPerm {
+		t.Errorf("trim replied with errno %d rather than %d", errno, errPerm)
+	}
+	if errno, _ := c.request(cmdRead, 0, 4, nil); errno != 0 {
+		t.Errorf("read failed with errno %d", errno)
+	}
+	if err := c.disconnect(); err != nil {
+		t.Errorf("server failed: %s", err.Error())
+	}
+}
@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"github.com/1ttric/shortenfs/internal/config"
+	"github.com/1ttric/shortenfs/internal/drivers"
+	"github.com/1ttric/shortenfs/internal/nbd"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// Serves the volume over NBD at the given address until interrupted, as an alternative to mounting it through FUSE
+func ServeNBD(listen string, driver drivers.Driver, readOnly bool) {
+	block := openVolume(driver, config.MainConfig, readOnly)
+
+	network, address := "tcp", listen
+	if strings.HasPrefix(listen, "unix:") {
+		network, address = "unix", strings.TrimPrefix(listen, "unix:")
+		// Remove the socket in case of a previous dirty exit
+		_ = os.Remove(address)
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := &nbd.Server{Device: block, ExportName: "shortenfs", ReadOnly: readOnly}
+	sigs := make(chan os.Signal, 1)
+	done := make(chan struct{}, 2)
+	stopFlusher := make(chan struct{})
+	signal.Notify(sigs, syscall.SIGINT)
+	go func() {
+		<-sigs
+		log.Infof("stopping nbd server")
+		_ = listener.Close()
+		done <- struct{}{}
+	}()
+	go func() {
+		_ = server.Serve(listener)
+		done <- struct{}{}
+	}()
+	if readOnly {
+		log.Infof("serving nbd read-only on %s at root %s", listen, block.GetRootID())
+		<-done
+		_ = block.Close()
+		return
+	}
+	go block.RunFlusher(stopFlusher)
+	log.Infof("serving nbd on %s", listen)
+	<-done
+	close(stopFlusher)
+	saveVolume(block)
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultMemoryCacheSize = 64 << 20
+
+// Holds the contents of recently used nodes in memory, so that most reads need no request at all. Node IDs are
+// immutable, so entries never expire, and the least recently used are evicted once the cache exceeds its size. Leaves
+// are always evicted before interior nodes: every read passes through the same few interior nodes near the root, so
+// they are worth far more than any one leaf, and take up little room by comparison
+type nodeCache struct {
+	lock     sync.Mutex
+	maxBytes int64
+	size     int64
+	// Entries from most to least recently used, kept separately for interior nodes and leaves
+	interior *list.List
+	leaves   *list.List
+	entries  map[string]*list.Element
+
+	hits   int64
+	misses int64
+}
+
+type nodeCacheEntry struct {
+	id       string
+	data     []byte
+	interior bool
+}
+
+func newNodeCache(maxBytes int64) *nodeCache {
+	if maxBytes <= 0 {
+		maxBytes = defaultMemoryCacheSize
+	}
+	return &nodeCache{
+		maxBytes: maxBytes,
+		interior: list.New(),
+		leaves:   list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Returns the contents of a cached node, if present
+func (c *nodeCache) get(id string) ([]byte, bool) {
+	c.lock.Lock()
+	element, ok := c.entries[id]
+	var data []byte
+	if ok {
+		entry := element.Value.(*nodeCacheEntry)
+		c.list(entry.interior).MoveToFront(element)
+		data = entry.data
+	}
+	c.lock.Unlock()
+	if ok {
+		atomic.AddInt64(&c.hits, 1)
+	} else {
+		atomic.AddInt64(&c.misses, 1)
+	}
+	return data, ok
+}
+
+// Adds a node to the cache, evicting leaves and then interior nodes as needed to make room for it
+func (c *nodeCache) put(id string, data []byte, interior bool) {
+	if int64(len(data)) > c.maxBytes {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.entries[id]; ok {
+		return
+	}
+	c.entries[id] = c.list(interior).PushFront(&nodeCacheEntry{id: id, data: data, interior: interior})
+	c.size += int64(len(data))
+	for c.size > c.maxBytes {
+		victims := c.leaves
+		if victims.Len() == 0 {
+			victims = c.interior
+		}
+		entry := victims.Remove(victims.Back()).(*nodeCacheEntry)
+		delete(c.entries, entry.id)
+		c.size -= int64(len(entry.data))
+	}
+}
+
+func (c *nodeCache) list(interior bool) *list.List {
+	if interior {
+		return c.interior
+	}
+	return c.leaves
+}
+
+// Returns the total size of the nodes held
+func (c *nodeCache) bytes() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.size
+}
+
+// Returns the number of lookups which found a cached node, and the number which did not
+func (c *nodeCache) stats() (hits int64, misses int64) {
+	return atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.misses)
+}
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// The cache must hold no more than its size in bytes, evicting the least recently used nodes first
+func TestNodeCacheEviction(t *testing.T) {
+	cache := newNodeCache(1000)
+	for i := 0; i < 4; i++ {
+		cache.put(fmt.Sprint(i), make([]byte, 300), false)
+	}
+	if size := cache.bytes(); size != 900 {
+		t.Errorf("cache holds %d bytes rather than 900", size)
+	}
+	if _, ok := cache.get("0"); ok {
+		t.Errorf("least recently used leaf was not evicted")
+	}
+
+	// Reading a node makes it the most recently used, so the next put evicts the node after it instead
+	cache.get("1")
+	cache.put("4", make([]byte, 300), false)
+	for id, cached := range map[string]bool{"1": true, "2": false, "3": true, "4": true} {
+		if _, ok := cache.get(id); ok != cached {
+			t.Errorf("leaf %s cached is %t rather than %t", id, ok, cached)
+		}
+	}
+
+	// Nodes larger than the whole cache are not cached, rather than emptying it
+	cache.put("5", make([]byte, 1001), false)
+	if _, ok := cache.get("5"); ok || cache.bytes() != 900 {
+		t.Errorf("node larger than the cache was cached")
+	}
+	if hits, misses := cache.stats(); hits != 4 || misses != 3 {
+		t.Errorf("cache counted %d hits and %d misses rather than 4 and 3", hits, misses)
+	}
+}
+
+// Leaves must be evicted before any interior node, however recently the interior nodes were used
+func TestNodeCacheKeepsInterior(t *testing.T) {
+	cache := newNodeCache(1000)
+	cache.put("root", make([]byte, 200), true)
+	cache.put("branch", make([]byte, 200), true)
+	for i := 0; i < 10; i++ {
+		cache.put(fmt.Sprint("leaf", i), make([]byte, 200), false)
+	}
+	for _, id := range []string{"root", "branch", "leaf9", "leaf8", "leaf7"} {
+		if _, ok := cache.get(id); !ok {
+			t.Errorf("%s was evicted", id)
+		}
+	}
+	if _, ok := cache.get("leaf6"); ok {
+		t.Errorf("leaf was kept over an interior node")
+	}
+
+	// Without leaves to evict, interior nodes are evicted least recently used first
+	cache = newNodeCache(1000)
+	cache.put("root", make([]byte, 400), true)
+	cache.put("branch", make([]byte, 400), true)
+	cache.get("root")
+	cache.put("trunk", make([]byte, 400), true)
+	if _, ok := cache.get("branch"); ok {
+		t.Errorf("least recently used interior node was not evicted")
+	}
+	if _, ok := cache.get("root"); !ok {
+		t.Errorf("recently used interior node was evicted")
+	}
+}
+
+// Node IDs are immutable, so caching a node which is already cached must change nothing, nor count its size twice
+func TestNodeCacheSameID(t *testing.T) {
+	cache := newNodeCache(1000)
+	data := bytes.Repeat([]byte("shortenfs"), 20)
+	cache.put("node", data, false)
+	cache.put("node", data, false)
+	cache.put("node", data, true)
+	if size := cache.bytes(); size != int64(len(data)) {
+		t.Errorf("cache holds %d bytes for a %d byte node", size, len(data))
+	}
+	if cached, ok := cache.get("node"); !ok || !bytes.Equal(cached, data) {
+		t.Errorf("node does not read back from the cache")
+	}
+	if cache.leaves.Len() != 1 || cache.interior.Len() != 0 {
+		t.Errorf("cache lists %d leaves and %d interior nodes rather than one leaf", cache.leaves.Len(),
+			cache.interior.Len())
+	}
+
+	// The node is evicted once, leaving nothing behind
+	for i := 0; i < 4; i++ {
+		cache.put(fmt.Sprint(i), make([]byte, 300), false)
+	}
+	if _, ok := cache.get("node"); ok {
+		t.Errorf("node was not evicted")
+	}
+	if size := cache.bytes(); size != 900 || len(cache.entries) != 3 {
+		t.Errorf("cache holds %d bytes in %d entries rather than 900 in 3", size, len(cache.entries))
+	}
+}
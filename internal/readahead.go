@@ -0,0 +1,215 @@
+package internal
+
+import (
+	log "github.com/sirupsen/logrus"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReadahead = 32
+	// Leaves prefetched when too little is known about the driver to size the window
+	minReadahead = 4
+	// Sequential reads in a row needed before prefetching starts
+	readaheadTrigger = 2
+	// Weight given to each new sample in the moving averages
+	readaheadSmoothing = 0.2
+)
+
+// Detects sequential reads and prefetches the leaves which follow them into the read cache, along with the interior
+// nodes needed to reach them, so that they are already present when read. The number of leaves prefetched covers the
+// driver's latency at the rate leaves are being read, so slow drivers and fast readers both get a larger window
+type readahead struct {
+	lock sync.Mutex
+	// Most leaves to prefetch ahead of a read, or 0 if disabled
+	maxWindow int
+	// Last leaf touched by the previous read, and how many reads in a row have carried on from the one before
+	lastLeaf   int
+	sequential int
+	// When the reads last moved on to a new leaf
+	lastAdvance time.Time
+	// Moving averages of the time taken to read through one leaf, and of the time taken to fetch a node
+	leafInterval time.Duration
+	latency      time.Duration
+	// Leaves from next to to (inclusive) are waiting to be prefetched by the prefetcher, if it is running
+	next    int
+	to      int
+	running bool
+	closed  bool
+}
+
+// A fetch of a node in progress, which other reads of the same node wait for
+type fetch struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+func newReadahead(maxWindow int) *readahead {
+	if maxWindow == 0 {
+		maxWindow = defaultReadahead
+	} else if maxWindow < 0 {
+		maxWindow = 0
+	}
+	return &readahead{maxWindow: maxWindow, lastLeaf: -1}
+}
+
+// Returns the number of leaves to prefetch: enough to cover the driver's latency at the current read rate, twice
+// over so that the prefetcher stays ahead
+func (r *readahead) window() int {
+	window := minReadahead
+	if r.leafInterval > 0 && r.latency > 0 {
+		window = 2 * int(math.Ceil(float64(r.latency)/float64(r.leafInterval)))
+	}
+	if window < minReadahead {
+		window = minReadahead
+	}
+	if window > r.maxWindow {
+		window = r.maxWindow
+	}
+	return window
+}
+
+func smooth(average time.Duration, sample time.Duration) time.Duration {
+	if average == 0 {
+		return sample
+	}
+	return time.Duration((1-readaheadSmoothing)*float64(average) + readaheadSmoothing*float64(sample))
+}
+
+// Records how long a node took to arrive from the shortener
+func (r *readahead) recordLatency(latency time.Duration) {
+	r.lock.Lock()
+	r.latency = smooth(r.latency, latency)
+	r.lock.Unlock()
+}
+
+// Records a read of the given leaves (endLeafIdx exclusive), and starts prefetching if the reads are sequential
+func (s *ShortenBlock) observeRead(startLeafIdx int, endLeafIdx int) {
+	r := s.readahead
+	if r.maxWindow == 0 || endLeafIdx <= startLeafIdx {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	lastLeaf := endLeafIdx - 1
+	// Small reads often fall within the leaf the previous read ended in
+	if startLeafIdx == r.lastLeaf || startLeafIdx == r.lastLeaf+1 {
+		r.sequential++
+		if lastLeaf > r.lastLeaf {
+			if !r.lastAdvance.IsZero() {
+				r.leafInterval = smooth(r.leafInterval, now.Sub(r.lastAdvance)/time.Duration(lastLeaf-r.lastLeaf))
+			}
+			r.lastAdvance = now
+		}
+	} else {
+		// Anything still queued belongs to the previous stream
+		r.sequential = 0
+		r.lastAdvance = now
+		r.next, r.to = 0, -1
+	}
+	r.lastLeaf = lastLeaf
+	if r.sequential < readaheadTrigger || r.closed {
+		return
+	}
+
+	leaves := int(math.Pow(float64(s.idsPerNode), float64(s.depth)))
+	if r.next <= lastLeaf {
+		r.next = lastLeaf + 1
+	}
+	if to := lastLeaf + r.window(); to > r.to {
+		r.to = to
+	}
+	if r.to >= leaves {
+		r.to = leaves - 1
+	}
+	if !r.running && r.next <= r.to {
+		r.running = true
+		go s.prefetch()
+	}
+}
+
+// Prefetches queued leaves in batches until none remain
+func (s *ShortenBlock) prefetch() {
+	r := s.readahead
+	for {
+		r.lock.Lock()
+		if r.next > r.to || r.closed {
+			r.running = false
+			r.lock.Unlock()
+			return
+		}
+		from, to := r.next, r.to
+		if to >= from+cap(s.workers) {
+			to = from + cap(s.workers) - 1
+		}
+		r.next = to + 1
+		r.lock.Unlock()
+		s.prefetchLeaves(from, to)
+	}
+}
+
+// Fetches the given leaves (inclusive) into the read cache. Failures are left for the reads which need the leaves to
+// report
+func (s *ShortenBlock) prefetchLeaves(from int, to int) {
+	log.Tracef("prefetching leaves %d to %d", from, to)
+	refs := make([]childRef, to-from+1)
+	s.lock.RLock()
+	for i := range refs {
+		leaf, err := s.getLeaf(from + i)
+		if err != nil {
+			s.lock.RUnlock()
+			log.Debugf("could not prefetch leaf %d: %s", from+i, err.Error())
+			return
+		}
+		leaf.lock.Lock()
+		if leaf.data == nil {
+			refs[i] = childRef{id: leaf.id, hash: leaf.hash}
+		}
+		leaf.lock.Unlock()
+	}
+	s.lock.RUnlock()
+
+	_ = s.parallel(len(refs), func(i int) error {
+		if refs[i].id != "" {
+			if _, err := s.cachedNodeRead(refs[i], s.depth, from+i); err != nil {
+				log.Debugf("could not prefetch leaf %d: %s", from+i, err.Error())
+			}
+		}
+		return nil
+	})
+}
+
+// Fetches and verifies a node from the shortener, unless it is already being fetched, in which case that fetch is
+// waited for instead. This way a read of a leaf which is still being prefetched costs no further request
+func (s *ShortenBlock) sharedRead(ref childRef, level int, leafIdx int) ([]byte, error) {
+	s.fetchesLock.Lock()
+	if f, ok := s.fetches[ref.id]; ok {
+		s.fetchesLock.Unlock()
+		<-f.done
+		return f.data, f.err
+	}
+	f := &fetch{done: make(chan struct{})}
+	s.fetches[ref.id] = f
+	s.fetchesLock.Unlock()
+
+	start := time.Now()
+	f.data, f.err = s.verifiedRead(ref, level, leafIdx)
+	if f.err == nil {
+		s.readahead.recordLatency(time.Since(start))
+	}
+	s.fetchesLock.Lock()
+	delete(s.fetches, ref.id)
+	s.fetchesLock.Unlock()
+	close(f.done)
+	return f.data, f.err
+}
+
+// Stops any prefetching
+func (r *readahead) close() {
+	r.lock.Lock()
+	r.closed = true
+	r.lock.Unlock()
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/1ttric/shortenfs/internal/drivers/memory"
+	"testing"
+	"time"
+)
+
+// Opens a volume of 40 distinct leaves with the given readahead limit, as slow to fetch from as the limit allows
+func readaheadVolume(t *testing.T, limit int) *ShortenBlock {
+	driver := &memory.Memory{NodeBytes: 512, IdLength: 8}
+	leaves := make([][]byte, 40)
+	for i := range leaves {
+		leaves[i] = []byte(fmt.Sprintf("leaf %d", i))
+	}
+	_, cfg := checksummedVolume(t, driver, leaves...)
+	cfg.Readahead = limit
+	block, err := OpenReadOnly(driver, cfg)
+	if err != nil {
+		t.Fatalf("could not reopen volume: %s", err.Error())
+	}
+	// The window covers the driver's latency, so a latency far beyond the time between reads sizes it at the limit
+	block.readahead.latency = time.Hour
+	return block
+}
+
+// Reads each of the given leaves in turn, then waits for any prefetching to finish
+func readLeaves(t *testing.T, block *ShortenBlock, leafIdxs ...int) {
+	for _, leafIdx := range leafIdxs {
+		if _, err := block.Read(block.shortener.NodeSize(), leafIdx*block.shortener.NodeSize()); err != nil {
+			t.Fatalf("could not read leaf %d: %s", leafIdx, err.Error())
+		}
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(time.Millisecond) {
+		block.readahead.lock.Lock()
+		running := block.readahead.running
+		block.readahead.lock.Unlock()
+		if !running {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("prefetching did not finish")
+		}
+	}
+}
+
+// Returns the indices of the leaves held in the read cache
+func cachedLeaves(t *testing.T, block *ShortenBlock) []int {
+	// Finding the leaves reads interior nodes through the cache, so this is done before looking in it
+	ids := make([]string, 40)
+	block.lock.RLock()
+	for i := range ids {
+		leaf, err := block.getLeaf(i)
+		if err != nil {
+			block.lock.RUnlock()
+			t.Fatalf("could not find leaf %d: %s", i, err.Error())
+		}
+		ids[i] = leaf.id
+	}
+	block.lock.RUnlock()
+
+	block.readCache.lock.Lock()
+	defer block.readCache.lock.Unlock()
+	var cached []int
+	for i, id := range ids {
+		if _, ok := block.readCache.entries[id]; ok {
+			cached = append(cached, i)
+		}
+	}
+	return cached
+}
+
+func expectCached(t *testing.T, name string, block *ShortenBlock, expected []int) {
+	cached := cachedLeaves(t, block)
+	if fmt.Sprint(cached) != fmt.Sprint(expected) {
+		t.Errorf("%s: leaves %v cached rather than %v", name, cached, expected)
+	}
+}
+
+// Returns the leaves from from to to (inclusive)
+func leafRange(from int, to int) []int {
+	var leaves []int
+	for i := from; i <= to; i++ {
+		leaves = append(leaves, i)
+	}
+	return leaves
+}
+
+// Sequential reads must prefetch the leaves which follow them, up to the readahead limit and no further
+func TestSequentialReadahead(t *testing.T) {
+	block := readaheadVolume(t, 8)
+	readLeaves(t, block, 3, 4)
+	expectCached(t, "before the trigger", block, leafRange(3, 4))
+	readLeaves(t, block, 5)
+	expectCached(t, "after three sequential reads", block, leafRange(3, 13))
+	readLeaves(t, block, 6, 7, 8)
+	expectCached(t, "after six sequential reads", block, leafRange(3, 16))
+}
+
+// Reads which do not follow on from one another must not prefetch anything
+func TestRandomReadahead(t *testing.T) {
+	block := readaheadVolume(t, 8)
+	readLeaves(t, block, 20, 5, 30, 12, 25, 1, 38)
+	expectCached(t, "random reads", block, []int{1, 5, 12, 20, 25, 30, 38})
+
+	// A sequential stream starting after random reads is prefetched as usual
+	readLeaves(t, block, 14, 15, 16)
+	expectCached(t, "sequential after random reads", block, append([]int{1, 5, 12}, append(leafRange(14, 24),
+		25, 30, 38)...))
+}
+
+// A readahead limit of -1 must disable prefetching altogether
+func TestReadaheadDisabled(t *testing.T) {
+	block := readaheadVolume(t, -1)
+	readLeaves(t, block, 0, 1, 2, 3, 4, 5)
+	expectCached(t, "sequential reads", block, leafRange(0, 5))
+}
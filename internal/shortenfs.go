@@ -2,26 +2,37 @@ package internal
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"fmt"
 	"github.com/1ttric/shortenfs/internal/config"
 	"github.com/1ttric/shortenfs/internal/drivers"
-	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
 	"math"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-var (
-	// A read cache is used so that every single read doesn't need a complete HTTP roundtrip
-	readCache = cache.New(5*time.Minute, 10*time.Minute)
-)
-
 // Used to store the filesystem node tree - parent short IDs can contain multiple child short IDs, with leaf nodes
 // pointing to chunks of actual data
 type Node struct {
-	id       string
+	// Guards the fields below against concurrent readers and writers. Children are only ever populated once, so the
+	// slice itself may be traversed without holding the lock once loaded
+	lock sync.Mutex
+
+	id string
+	// Checksum of the node's contents, as recorded by its parent, for volumes with checksums
+	hash     string
 	parent   *Node
 	children []*Node
+
+	// Modified contents of a leaf node, held in memory until the next flush
+	data []byte
+	// Set when this node or any of its descendants has been modified since the last flush
+	dirty bool
 }
 
 type ShortenBlock struct {
@@ -29,52 +40,190 @@ type ShortenBlock struct {
 	depth int
 	// Stores the top-level node of shortened data
 	tree *Node
+	// ID of the superblock describing the tree, which identifies the volume as a whole, and for volumes with checksums
+	// the checksum of the superblock, which commits to the entire contents of the volume
+	rootID   string
+	rootHash string
 	// The actual shortener implementation to use (tinyurl, bitly, etc)
+	backend drivers.Driver
+	// The backend wrapped in any transformations applied to tree nodes, such as compression and encryption
 	shortener drivers.Driver
+	// Options the volume was created with, as recorded in the superblock
+	volume superblock
+	// Index of previously written payloads, if one is configured
+	dedup *dedupIndex
+	// Recently used node contents, so that every single read doesn't need a complete HTTP roundtrip
+	readCache *nodeCache
+	// Local cache of node contents in front of the backend, which outlives the process, if configured
+	cache *diskCache
+	// Prefetches leaves ahead of sequential reads
+	readahead *readahead
+	// Nodes currently being fetched from the shortener, by ID
+	fetches     map[string]*fetch
+	fetchesLock sync.Mutex
+	// Set when serving a volume which must not be modified, such as a historical root
+	readOnly bool
+	// File to which each new root ID is appended after a flush, if one is configured
+	historyPath string
 
 	// Number of child node IDs per parent node, accounting for comma separators
 	idsPerNode int
+
+	// Held for reading by FUSE requests, which synchronize among themselves through per-node locks, and held for
+	// writing by flushes while they capture the dirty part of the tree and record the IDs it was uploaded as
+	lock sync.RWMutex
+	// Held for the whole of a flush, so that only one runs at a time. Node IDs only ever change while it is held
+	flushLock sync.Mutex
+	// Semaphore bounding the number of concurrent requests to the shortener
+	workers chan struct{}
+	// Number of leaves holding data which has not yet been uploaded, accessed atomically
+	dirtyLeaves int64
+	// Dirty leaves are flushed once this many accumulate, or once flushInterval passes
+	maxDirty      int64
+	flushInterval time.Duration
+}
+
+// Opens the configured volume, exiting if it cannot be opened
+func NewShortenBlock(backend drivers.Driver, config config.ShortenBlockConfig) *ShortenBlock {
+	s, err := OpenShortenBlock(backend, config)
+	if err != nil {
+		log.Fatalf("could not open volume: %s", err.Error())
+	}
+	return s
+}
+
+// Opens a volume which must not be modified, such as a historical root. Nothing is written to the shortener or to the
+// volume's dedup index or history, though nodes read are still added to the node cache
+func OpenReadOnly(backend drivers.Driver, config config.ShortenBlockConfig) (*ShortenBlock, error) {
+	config.DedupIndex = ""
+	config.History = ""
+	s, err := OpenShortenBlock(backend, config)
+	if err != nil {
+		return nil, err
+	}
+	s.readOnly = true
+	return s, nil
+}
+
+// Opens a volume to be mounted or served, read-only as by OpenReadOnly if requested, exiting if it cannot be opened
+func openVolume(backend drivers.Driver, config config.ShortenBlockConfig, readOnly bool) *ShortenBlock {
+	if !readOnly {
+		return NewShortenBlock(backend, config)
+	}
+	s, err := OpenReadOnly(backend, config)
+	if err != nil {
+		log.Fatalf("could not open volume: %s", err.Error())
+	}
+	return s
 }
 
-func NewShortenBlock(shortener drivers.Driver, config config.ShortenBlockConfig) *ShortenBlock {
-	if config.Depth <= 0 {
-		log.Fatalf("invalid depth")
+// Opens the configured volume, reading its superblock if it already exists
+func OpenShortenBlock(backend drivers.Driver, config config.ShortenBlockConfig) (*ShortenBlock, error) {
+	maxDirty := int64(config.MaxDirty)
+	if maxDirty <= 0 {
+		maxDirty = 1024
 	}
+	flushInterval := config.FlushInterval
+	if flushInterval <= 0 {
+		flushInterval = 30 * time.Second
+	}
+	workers := config.Workers
+	if workers <= 0 {
+		workers = 4
+	}
+	s := &ShortenBlock{
+		backend:       backend,
+		maxDirty:      maxDirty,
+		flushInterval: flushInterval,
+		workers:       make(chan struct{}, workers),
+		historyPath:   config.History,
+		readCache:     newNodeCache(config.MemoryCacheSize),
+		readahead:     newReadahead(config.Readahead),
+		fetches:       make(map[string]*fetch),
+	}
+	if config.CacheDir != "" {
+		cache, err := openDiskCache(config.CacheDir, config.CacheSize)
+		if err != nil {
+			return nil, err
+		}
+		s.backend = &cachedDriver{Driver: backend, cache: cache, driver: config.Driver}
+		s.cache = cache
+	}
+
+	var sb *superblock
+	var err error
 	if config.RootID == "" {
+		if config.Depth <= 0 {
+			return nil, fmt.Errorf("invalid depth")
+		}
 		log.Debugf("no defined root - creating new filesystem")
+		sb = &superblock{Driver: config.Driver, Depth: config.Depth, Compression: config.Compression,
+			Checksum: checksumMethod}
+	} else if sb, err = s.loadSuperblock(config); err != nil {
+		return nil, err
 	}
-	return &ShortenBlock{
-		depth:      config.Depth,
-		tree:       &Node{id: config.RootID},
-		shortener:  shortener,
-		idsPerNode: (shortener.NodeSize() + 1) / (shortener.IdSize() + 1),
+	if s.shortener, err = s.stackDrivers(sb, config); err != nil {
+		return nil, err
 	}
+	s.volume = *sb
+	s.depth = sb.Depth
+	s.tree = &Node{id: sb.Root, hash: sb.RootHash}
+	refSize := s.shortener.IdSize()
+	if sb.Checksum != "" {
+		refSize += 1 + checksumLength
+	}
+	s.idsPerNode = (s.shortener.NodeSize() + 1) / (refSize + 1)
+	if sb.Version > 0 {
+		if err = s.checkGeometry(sb); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.DedupIndex != "" && drivers.IsVolatile(backend) {
+		// Nothing written to the driver by an earlier run still exists, so no ID in the index can be trusted
+		log.Debugf("not using a dedup index, as driver %s does not keep its nodes", sb.Driver)
+	} else if config.DedupIndex != "" {
+		// Identical payloads only map to identical IDs on the same backend, with the same compression and key. The
+		// driver options identify the backend, such as the directory or account nodes are stored in
+		opts, err := yaml.Marshal(config.DriverOpts)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not marshal driver options")
+		}
+		scope := fmt.Sprintf("%s/%x/%s/%s/%x", sb.Driver, sha256.Sum256(opts), sb.Compression, sb.Encryption,
+			sb.KeyCheck)
+		if s.dedup, err = openDedupIndex(config.DedupIndex, scope); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
 }
 
 // Fetches the leaf node indexed by leafIdx
 func (s *ShortenBlock) getLeaf(leafIdx int) (*Node, error) {
-	// Plots the child index for each node of the tree we need to visit to get to the final requested leaf
-	var path []int
-	for level := 0; level < s.depth; level++ {
-		childIdx := (leafIdx / int(math.Pow(float64(s.idsPerNode), float64(level)))) % s.idsPerNode
-		path = append([]int{childIdx}, path...)
-	}
+	return s.nodeAt(s.depth, leafIdx)
+}
 
+// Returns the node at the given level of the tree (0 being the root, and the depth being the leaves) which contains the
+// given leaf
+func (s *ShortenBlock) nodeAt(level int, leafIdx int) (*Node, error) {
+	path := s.childPath(leafIdx)[:level]
 	log.Tracef("traversing path %v to leaf idx %d", path, leafIdx)
 	node := s.tree
-	for _, childIdx := range path {
+	for nodeLevel, childIdx := range path {
+		node.lock.Lock()
 		// Perform lazy initialization for nodes which have not been written to
 		if len(node.children) == 0 {
 			if node.id != "" {
 				// If a node is named, load its children from the shortener
 				var data []byte
 				var err error
-				if data, err = s.cachedNodeRead(node.id); err != nil {
+				if data, err = s.cachedNodeRead(childRef{id: node.id, hash: node.hash}, nodeLevel, leafIdx); err != nil {
+					node.lock.Unlock()
 					return nil, err
 				}
 				log.Tracef("node %s children are %s", node.id, string(data))
-				for _, childID := range strings.Split(strings.Trim(string(data), "\x00"), ",") {
-					node.children = append(node.children, &Node{id: childID, parent: node})
+				for _, ref := range parseChildren(data) {
+					node.children = append(node.children, &Node{id: ref.id, hash: ref.hash, parent: node})
 				}
 			} else {
 				// If a node has no name (is heretofore unwritten), create empty children for it
@@ -84,187 +233,641 @@ func (s *ShortenBlock) getLeaf(leafIdx int) (*Node, error) {
 			}
 		}
 
-		log.Tracef("node %s chose child idx %d: %s", node.id, childIdx, node.children[childIdx].id)
-		node = node.children[childIdx]
+		log.Tracef("node %s chose child idx %d", node.id, childIdx)
+		child := node.children[childIdx]
+		node.lock.Unlock()
+		node = child
 	}
 
 	return node, nil
 }
 
-// Read data from a node, but with a cache - this means reads do not require an entire HTTP roundtrip
-func (s *ShortenBlock) cachedNodeRead(id string) ([]byte, error) {
-	cachedData, ok := readCache.Get(id)
-	if ok {
-		log.Debugf("cache hit for id %s", id)
-		return cachedData.([]byte), nil
+// Plots the child index for each node of the tree we need to visit to get to the given leaf
+func (s *ShortenBlock) childPath(leafIdx int) []int {
+	var path []int
+	for height := 0; height < s.depth; height++ {
+		childIdx := (leafIdx / int(math.Pow(float64(s.idsPerNode), float64(height)))) % s.idsPerNode
+		path = append([]int{childIdx}, path...)
 	}
-	log.Debugf("reading %s", id)
-	data, err := s.shortener.Read(id)
+	return path
+}
+
+// Read data from a node, but with a cache - this means reads do not require an entire HTTP roundtrip. The node is
+// verified against its checksum, if any, with its level and a leaf beneath it locating it in the tree
+func (s *ShortenBlock) cachedNodeRead(ref childRef, level int, leafIdx int) ([]byte, error) {
+	if data, ok := s.readCache.get(ref.id); ok {
+		log.Debugf("cache hit for id %s", ref.id)
+		if err := s.verify(ref, data, level, leafIdx); err != nil {
+			log.Error(err.Error())
+			return nil, err
+		}
+		return data, nil
+	}
+	log.Debugf("reading %s", ref.id)
+	data, err := s.sharedRead(ref, level, leafIdx)
 	if err != nil {
+		if _, ok := errors.Cause(err).(*checksumError); ok {
+			log.Error(err.Error())
+		}
 		return nil, err
 	}
-	log.Debugf("read %d from %s", len(data), id)
-	readCache.SetDefault(id, data)
+	log.Debugf("read %d from %s", len(data), ref.id)
+	s.readCache.put(ref.id, data, level < s.depth)
 	return data, nil
 }
 
-// Writes the specified data to a node and updates the resulting short ID
-// Then, updates the parent node's data with the new short ID
-// This is performed recursively up to the root node
-func (s *ShortenBlock) nodeWrite(node *Node, data []byte) error {
-	var newID string
-	var err error
-	log.Debugf("writing %d bytes to node", len(data))
-	if newID, err = s.shortener.Write(data); err != nil {
-		return err
+// Writes a node directly to the shortener, waiting for a free worker first
+func (s *ShortenBlock) driverWrite(data []byte) (string, error) {
+	s.workers <- struct{}{}
+	defer func() { <-s.workers }()
+	return s.shortener.Write(data)
+}
+
+// Calls fn for each index up to n on its own goroutine, and returns the first error encountered once all have
+// finished. Goroutines are cheap - it is the workers semaphore which bounds the number of requests in flight
+func (s *ShortenBlock) parallel(n int, fn func(i int) error) error {
+	if n == 1 {
+		return fn(0)
+	}
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = fn(i)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
 	}
-	log.Tracef("node id changed from %s to %s", node.id, newID)
+	return nil
+}
 
-	node.id = newID
-	for {
-		node = node.parent
-		log.Tracef("updating parent node %s", node.id)
+// Returns the full contents of a leaf, preferring data which has not yet been flushed. Unwritten leaves read as zeros
+func (s *ShortenBlock) leafRead(leaf *Node, leafIdx int) ([]byte, error) {
+	if leaf.data != nil {
+		return leaf.data, nil
+	}
+	var leafData []byte
+	if leaf.id != "" {
+		var err error
+		if leafData, err = s.cachedNodeRead(childRef{id: leaf.id, hash: leaf.hash}, s.depth, leafIdx); err != nil {
+			return nil, err
+		}
+	}
+	if len(leafData) < s.shortener.NodeSize() {
+		leafData = append(leafData[:len(leafData):len(leafData)], bytes.Repeat([]byte{0}, s.shortener.NodeSize()-len(leafData))...)
+	}
+	return leafData, nil
+}
+
+// Replaces the contents of a leaf node in memory, marking it and all of its ancestors as dirty. Nothing is uploaded
+// until the next flush. The leaf must already be locked by the caller
+func (s *ShortenBlock) nodeWrite(node *Node, data []byte) {
+	if node.data == nil {
+		atomic.AddInt64(&s.dirtyLeaves, 1)
+	}
+	node.data = data
+	s.markDirty(node)
+}
 
-		var childIDs []string
-		for _, child := range node.children {
-			childIDs = append(childIDs, child.id)
+// Marks a node as modified, along with each of its ancestors. The node itself must already be locked
+func (s *ShortenBlock) markDirty(node *Node) {
+	node.dirty = true
+	for node = node.parent; node != nil; node = node.parent {
+		node.lock.Lock()
+		wasDirty := node.dirty
+		node.dirty = true
+		node.lock.Unlock()
+		if wasDirty {
+			break
 		}
-		newData := strings.Join(childIDs, ",")
-		log.Tracef("new child nodes are %s", newData)
+	}
+}
 
-		var newID string
-		log.Debugf("writing %d bytes to node parent", len(newData))
-		if newID, err = s.shortener.Write([]byte(newData)); err != nil {
+// A dirty node captured by a flush, along with what it will be uploaded as. The dirty part of the tree is captured
+// while holding the tree lock exclusively, uploaded without holding it, and the resulting IDs recorded under the lock
+// once more, so that reads and writes carry on while uploads are in progress
+type flushItem struct {
+	node *Node
+	// Contents of a leaf as captured. For interior nodes, the captured children which are dirty, and the references
+	// of those which are not
+	data     []byte
+	children []*flushItem
+	refs     []childRef
+	// Reference to the node as uploaded, which is empty for nodes that are entirely zero
+	ref      childRef
+	uploaded bool
+}
+
+// Captures a dirty node and each of its dirty descendants, clearing their dirty flags so that any writes made while
+// they are uploaded mark them dirty again. The tree lock must be held exclusively, so node locks are not needed
+func (s *ShortenBlock) captureDirty(node *Node) *flushItem {
+	if !node.dirty {
+		return nil
+	}
+	node.dirty = false
+	item := &flushItem{node: node}
+	if node.data != nil {
+		item.data = node.data
+		return item
+	}
+	item.children = make([]*flushItem, len(node.children))
+	item.refs = make([]childRef, len(node.children))
+	for i, child := range node.children {
+		if item.children[i] = s.captureDirty(child); item.children[i] == nil {
+			item.refs[i] = childRef{id: child.id, hash: child.hash}
+		}
+	}
+	return item
+}
+
+// Uploads a captured node, after first uploading any of its dirty children. Every dirty node is written exactly once,
+// regardless of how many writes were made to it or below it since the last flush. Sibling subtrees are independent, so
+// they are uploaded concurrently
+func (s *ShortenBlock) uploadItem(item *flushItem) error {
+	data := item.data
+	leaf := data != nil
+	// Empty IDs already read as zeros, so nodes which are entirely zero never need uploading
+	var empty bool
+	if leaf {
+		empty = allZero(data)
+	} else {
+		err := s.parallel(len(item.children), func(i int) error {
+			if item.children[i] == nil {
+				return nil
+			}
+			return s.uploadItem(item.children[i])
+		})
+		if err != nil {
 			return err
 		}
-		node.id = newID
-		for _, child := range node.children {
-			child.parent = node
+		empty = true
+		for i, child := range item.children {
+			if child != nil {
+				item.refs[i] = child.ref
+			}
+			empty = empty && item.refs[i].id == ""
 		}
-		if node.parent == nil {
-			break
+		data = formatChildren(item.refs)
+		log.Tracef("new child nodes are %s", data)
+	}
+
+	if empty {
+		log.Tracef("node %s is now empty", item.node.id)
+		item.uploaded = true
+		return nil
+	}
+	newID, err := s.dedupWrite(data)
+	if err != nil {
+		return err
+	}
+	log.Tracef("node id changed from %s to %s", item.node.id, newID)
+	s.readCache.put(newID, data, !leaf)
+	item.ref = s.newRef(newID, data)
+	item.uploaded = true
+	return nil
+}
+
+// Records the new references of uploaded nodes in the tree, and marks any which could not be uploaded as dirty again,
+// returning the number of leaves whose pending data was released. Leaves written to again since they were captured
+// keep their newer contents for the next flush. The tree lock must be held exclusively
+func (s *ShortenBlock) applyFlush(item *flushItem) int {
+	var released int
+	for _, child := range item.children {
+		if child != nil {
+			released += s.applyFlush(child)
 		}
 	}
+	node := item.node
+	if !item.uploaded {
+		node.dirty = true
+		return released
+	}
+	node.id, node.hash = item.ref.id, item.ref.hash
+	if node.data != nil && !node.dirty {
+		node.data = nil
+		released++
+	}
+	return released
+}
+
+// Writes a node payload, reusing the ID of an identical payload if one has been written before
+func (s *ShortenBlock) dedupWrite(data []byte) (string, error) {
+	if s.dedup != nil {
+		if id, ok := s.dedup.lookup(data, func(id string) bool { return s.nodeHolds(id, data) }); ok {
+			log.Tracef("dedup index hit for %d bytes: %s", len(data), id)
+			return id, nil
+		}
+	}
+	log.Debugf("writing %d bytes to node", len(data))
+	id, err := s.driverWrite(data)
+	if err != nil {
+		return "", err
+	}
+	if s.dedup != nil {
+		if err = s.dedup.record(data, id); err != nil {
+			log.Warnf("could not record %s in dedup index: %s", id, err.Error())
+		}
+	}
+	return id, nil
+}
+
+// Returns whether the node with the given ID can be read and holds the given payload
+func (s *ShortenBlock) nodeHolds(id string, data []byte) bool {
+	// The node cache would still answer for a node which the shortener has lost
+	if cached, ok := s.backend.(*cachedDriver); ok {
+		cached.forget(id)
+	}
+	s.workers <- struct{}{}
+	defer func() { <-s.workers }()
+	_, err := drivers.ReadVerified(s.shortener, id, func(stored []byte) error {
+		if !bytes.Equal(stored, data) {
+			return fmt.Errorf("node %s does not hold the payload it was recorded for", id)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Debugf("could not read %s to check it: %s", id, err.Error())
+		return false
+	}
+	return true
+}
+
+// Returns whether data consists only of zero bytes
+func allZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Uploads all dirty leaves, followed by each interior node above them, producing a new root ID. Reads and writes may
+// continue while the upload is in progress, and anything written meanwhile is left for the next flush
+func (s *ShortenBlock) Flush() error {
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
+	s.lock.Lock()
+	item := s.captureDirty(s.tree)
+	s.lock.Unlock()
+	if item == nil {
+		return nil
+	}
+
+	log.Debugf("flushing %d dirty leaves", atomic.LoadInt64(&s.dirtyLeaves))
+	err := s.uploadItem(item)
+	s.lock.Lock()
+	released := s.applyFlush(item)
+	s.lock.Unlock()
+	atomic.AddInt64(&s.dirtyLeaves, -int64(released))
+	if err != nil {
+		return err
+	}
+	if err = s.commitRoot(); err != nil {
+		return err
+	}
+	log.Debugf("flushed to new tree root %s with superblock %s", item.ref.id, s.GetRootID())
+	if s.dedup != nil {
+		hits, misses := s.dedup.stats()
+		log.Debugf("dedup index has %d hits and %d misses so far", hits, misses)
+	}
 	return nil
 }
 
+// Writes a superblock for the current tree, and records the resulting root ID in the history
+func (s *ShortenBlock) commitRoot() error {
+	if err := s.writeSuperblock(); err != nil {
+		return err
+	}
+	if s.historyPath != "" {
+		if err := appendHistory(s.historyPath, Snapshot{Time: time.Now(), RootID: s.rootID, RootHash: s.rootHash}); err != nil {
+			log.Warnf("could not record root %s in history: %s", s.rootID, err.Error())
+		}
+	}
+	return nil
+}
+
+// Flushes at the configured interval until stopped
+func (s *ShortenBlock) RunFlusher(stop <-chan struct{}) {
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				log.Errorf("periodic flush failed: %s", err.Error())
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
 // Returns the capacity, in raw bytes, of the filesystem
 func (s *ShortenBlock) Capacity() int {
 	return int(math.Pow(float64(s.idsPerNode), float64(s.depth))) * s.shortener.NodeSize()
 }
 
-// Presenting leaf nodes as a contiguous chunk, reads a chunk of the given size at a given offset
+// Whether the given range lies within the filesystem. Leaves are located by taking their index modulo each level's
+// span, so a range beyond the end would otherwise wrap around onto the start
+func (s *ShortenBlock) inRange(offset int, size int) bool {
+	return offset >= 0 && size >= 0 && offset <= s.Capacity() && size <= s.Capacity()-offset
+}
+
+// For a read or write of the given size at the given offset, returns the range of leaves it touches
+func (s *ShortenBlock) leafSpan(offset int, size int) (startLeafIdx int, endLeafIdx int) {
+	startLeafIdx = offset / s.shortener.NodeSize()
+	endLeafIdx = int(math.Ceil(float64(offset+size) / float64(s.shortener.NodeSize())))
+	return
+}
+
+// For a read or write of the given size at the given offset, returns the start and end indices of the affected range
+// within a particular leaf
+func (s *ShortenBlock) leafSubRange(leafIdx int, offset int, size int) (subStart int, subEnd int) {
+	startLeafIdx, endLeafIdx := s.leafSpan(offset, size)
+	if leafIdx == startLeafIdx {
+		subStart = offset % s.shortener.NodeSize()
+	} else {
+		subStart = 0
+	}
+	// Edge case where the range ends on the end border of the chunk
+	if leafIdx == endLeafIdx-1 && (offset+size)%s.shortener.NodeSize() != 0 {
+		subEnd = (offset + size) % s.shortener.NodeSize()
+	} else {
+		subEnd = s.shortener.NodeSize()
+	}
+	return
+}
+
+// Presenting leaf nodes as a contiguous chunk, reads a chunk of the given size at a given offset. Reads extending past
+// the end of the filesystem are cut short there, while reads starting beyond it fail
 func (s *ShortenBlock) Read(size int, offset int) ([]byte, error) {
 	log.Debugf("reading %d bytes at offset %d", size, offset)
+	capacity := s.Capacity()
+	if offset < 0 || size < 0 || offset > capacity {
+		return []byte{}, syscall.EINVAL
+	}
+	// Compared this way round so that sizes near the top of the range cannot overflow
+	if size > capacity-offset {
+		size = capacity - offset
+	}
 	// Determine which leaves will need to be accessed in order to satisfy the requested read
-	startLeafIdx := offset / s.shortener.NodeSize()
-	endLeafIdx := int(math.Ceil(float64(offset+size) / float64(s.shortener.NodeSize())))
+	startLeafIdx, endLeafIdx := s.leafSpan(offset, size)
+	s.observeRead(startLeafIdx, endLeafIdx)
 
-	var readData []byte
+	// Leaves are located while holding the tree lock, but their contents are fetched concurrently afterwards. Flushed
+	// IDs are immutable and pending data is never modified in place, so a copy of each leaf remains valid
+	leaves := make([]Node, endLeafIdx-startLeafIdx)
+	s.lock.RLock()
 	for leafIdx := startLeafIdx; leafIdx < endLeafIdx; leafIdx++ {
-		var leaf *Node
-		var err error
-		log.Debugf("reading from leaf %d of (%d, %d)", leafIdx, startLeafIdx, endLeafIdx)
-
-		if leaf, err = s.getLeaf(leafIdx); err != nil {
+		leaf, err := s.getLeaf(leafIdx)
+		if err != nil {
+			s.lock.RUnlock()
 			log.Debugf("error getting leaf %d: %s", leafIdx, err.Error())
 			return []byte{}, err
 		}
+		leaf.lock.Lock()
+		leaves[leafIdx-startLeafIdx] = Node{id: leaf.id, hash: leaf.hash, data: leaf.data}
+		leaf.lock.Unlock()
+	}
+	s.lock.RUnlock()
 
+	leavesData := make([][]byte, len(leaves))
+	err := s.parallel(len(leaves), func(i int) error {
+		log.Debugf("reading from leaf %d of (%d, %d)", startLeafIdx+i, startLeafIdx, endLeafIdx)
+		var err error
+		leavesData[i], err = s.leafRead(&leaves[i], startLeafIdx+i)
+		return err
+	})
+	if err != nil {
+		return []byte{}, err
+	}
+
+	var readData []byte
+	for i, leafData := range leavesData {
 		// For this leaf, calculate the subread start and end indices
-		var subReadStart int
-		var subReadEnd int
-		if leafIdx == startLeafIdx {
-			subReadStart = offset % s.shortener.NodeSize()
-		} else {
-			subReadStart = 0
-		}
-		if leafIdx == endLeafIdx-1 {
-			// Edge case where readEnd is on the end border of the chunk
-			//log.Trace((offset + size) % NodeSize)
-			if (offset+size)%s.shortener.NodeSize() == 0 {
-				subReadEnd = s.shortener.NodeSize()
-			} else {
-				subReadEnd = (offset + size) % s.shortener.NodeSize()
-			}
-		} else {
-			subReadEnd = s.shortener.NodeSize()
-		}
+		subReadStart, subReadEnd := s.leafSubRange(startLeafIdx+i, offset, size)
 		log.Tracef("leaf subread indices: (%d, %d)", subReadStart, subReadEnd)
-
-		var leafData []byte
-		if leaf.id != "" {
-			if leafData, err = s.cachedNodeRead(leaf.id); err != nil {
-				return []byte{}, err
-			}
-		} else {
-			leafData = bytes.Repeat([]byte{0}, s.shortener.NodeSize())
-		}
-		leafData = append(leafData, bytes.Repeat([]byte{0}, s.shortener.NodeSize()-len(leafData))...)
-		subReadData := leafData[subReadStart:subReadEnd]
-
-		readData = append(readData, subReadData...)
+		readData = append(readData, leafData[subReadStart:subReadEnd]...)
 	}
 	return readData, nil
 }
 
-// Presenting leaf nodes as a contiguous chunk, writes the given data at the given offset
+// Presenting leaf nodes as a contiguous chunk, writes the given data at the given offset. Writes extending past the end
+// of the filesystem fail without writing anything
 func (s *ShortenBlock) Write(offset int, data []byte) (int, error) {
 	size := len(data)
 	log.Debugf("writing %d bytes at offset %d", size, offset)
-	startLeafIdx := offset / s.shortener.NodeSize()
-	endLeafIdx := int(math.Ceil(float64(offset+size) / float64(s.shortener.NodeSize())))
+	if s.readOnly {
+		return 0, syscall.EROFS
+	}
+	if !s.inRange(offset, size) {
+		return 0, syscall.ENOSPC
+	}
+	bytesWritten, err := s.write(offset, data)
+	if err != nil {
+		return bytesWritten, err
+	}
+	if dirtyLeaves := atomic.LoadInt64(&s.dirtyLeaves); dirtyLeaves >= s.maxDirty {
+		log.Debugf("%d dirty leaves reached limit", dirtyLeaves)
+		// The data is buffered whether or not the flush succeeds, and leaves which failed to upload are retried by the
+		// next flush, so the write itself has succeeded
+		if err := s.Flush(); err != nil {
+			log.Errorf("could not flush %d dirty leaves: %s", dirtyLeaves, err.Error())
+		}
+	}
+	return bytesWritten, nil
+}
 
-	bytesWritten := 0
+// Writes the given data at the given offset into memory, without flushing
+func (s *ShortenBlock) write(offset int, data []byte) (int, error) {
+	size := len(data)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	startLeafIdx, endLeafIdx := s.leafSpan(offset, size)
 
+	// Every leaf being written is locked for the duration of its read-modify-write. Leaves are always locked in
+	// ascending order, so overlapping writes cannot deadlock
+	leaves := make([]*Node, endLeafIdx-startLeafIdx)
 	for leafIdx := startLeafIdx; leafIdx < endLeafIdx; leafIdx++ {
-		log.Debugf("writing to leaf %d of range (%d, %d)", leafIdx, startLeafIdx, endLeafIdx)
-		var leaf *Node
-		var err error
-		if leaf, err = s.getLeaf(int(leafIdx)); err != nil {
+		leaf, err := s.getLeaf(leafIdx)
+		if err != nil {
 			log.Debugf("could not retrieve leaf: %s", err.Error())
-			return 0, nil
+			for _, locked := range leaves[:leafIdx-startLeafIdx] {
+				locked.lock.Unlock()
+			}
+			return 0, err
+		}
+		leaf.lock.Lock()
+		leaves[leafIdx-startLeafIdx] = leaf
+	}
+	defer func() {
+		for _, leaf := range leaves {
+			leaf.lock.Unlock()
 		}
+	}()
 
-		var subWriteStart int
-		var subWriteEnd int
-		if leafIdx == startLeafIdx {
-			subWriteStart = offset % s.shortener.NodeSize()
-		} else {
-			subWriteStart = 0
+	// Only leaves which are partially overwritten need their previous contents, and these are fetched concurrently
+	leavesData := make([][]byte, len(leaves))
+	err := s.parallel(len(leaves), func(i int) error {
+		subWriteStart, subWriteEnd := s.leafSubRange(startLeafIdx+i, offset, size)
+		if subWriteStart == 0 && subWriteEnd == s.shortener.NodeSize() {
+			leavesData[i] = make([]byte, s.shortener.NodeSize())
+			return nil
 		}
-		if leafIdx == endLeafIdx-1 {
-			subWriteEnd = (offset + size) % s.shortener.NodeSize()
-		} else {
-			subWriteEnd = s.shortener.NodeSize()
+		leafData, err := s.leafRead(leaves[i], startLeafIdx+i)
+		if err != nil {
+			log.Errorf("could not read leaf data: %s", err.Error())
+			return err
 		}
+		// Leaf data may be shared with the read cache, so the new leaf is built in a fresh buffer
+		leavesData[i] = make([]byte, len(leafData))
+		copy(leavesData[i], leafData)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
 
-		var leafData []byte
-		if leaf.id != "" {
-			if leafData, err = s.cachedNodeRead(leaf.id); err != nil {
-				log.Errorf("could not read leaf data: %s", err.Error())
-				return 0, err
-			}
-		} else {
-			leafData = bytes.Repeat([]byte{0}, s.shortener.NodeSize())
-		}
-		log.Tracef("concatenating old leaf data of length %d with range (%d, %d)", len(leafData), subWriteStart, subWriteEnd)
-		newLeafData := leafData[:subWriteStart]
-		newLeafData = append(newLeafData, data[:subWriteEnd-subWriteStart]...)
-		newLeafData = append(newLeafData, leafData[int(math.Min(float64(subWriteEnd), float64(len(leafData)))):]...)
+	bytesWritten := 0
+	for i, leaf := range leaves {
+		log.Debugf("writing to leaf %d of range (%d, %d)", startLeafIdx+i, startLeafIdx, endLeafIdx)
+		subWriteStart, subWriteEnd := s.leafSubRange(startLeafIdx+i, offset, size)
+		log.Tracef("overwriting leaf range (%d, %d)", subWriteStart, subWriteEnd)
+		copy(leavesData[i][subWriteStart:subWriteEnd], data)
 		data = data[subWriteEnd-subWriteStart:]
 
-		err = s.nodeWrite(leaf, newLeafData)
+		s.nodeWrite(leaf, leavesData[i])
+		bytesWritten += subWriteEnd - subWriteStart
+	}
+	return bytesWritten, nil
+}
+
+// Zeroes the given range. Subtrees which lie entirely within it are cut from the tree without reading them, and
+// leaves which end up entirely zero are elided on the next flush, freeing their storage
+func (s *ShortenBlock) Discard(offset int, size int) error {
+	if s.readOnly {
+		return syscall.EROFS
+	}
+	if !s.inRange(offset, size) {
+		return syscall.ENOSPC
+	}
+	nodeSize := s.shortener.NodeSize()
+	// Leaves only partially covered at either end keep the rest of their contents
+	if head := offset % nodeSize; head != 0 && size > 0 {
+		n := nodeSize - head
+		if n > size {
+			n = size
+		}
+		if _, err := s.Write(offset, make([]byte, n)); err != nil {
+			return err
+		}
+		offset += n
+		size -= n
+	}
+	if tail := size % nodeSize; tail != 0 {
+		if _, err := s.Write(offset+size-tail, make([]byte, tail)); err != nil {
+			return err
+		}
+		size -= tail
+	}
+	if size == 0 {
+		return nil
+	}
+	return s.cutLeaves(offset/nodeSize, (offset+size)/nodeSize)
+}
+
+// Empties the given leaves (endLeafIdx exclusive), cutting off the largest subtrees which lie entirely within them.
+// Node IDs and children change here, so this holds the flush lock as well as the tree lock
+func (s *ShortenBlock) cutLeaves(startLeafIdx int, endLeafIdx int) error {
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// Pending leaf data is never modified in place, so every emptied leaf can share the same zeros
+	zeros := make([]byte, s.shortener.NodeSize())
+	for leafIdx := startLeafIdx; leafIdx < endLeafIdx; {
+		level, span := 0, int(math.Pow(float64(s.idsPerNode), float64(s.depth)))
+		for leafIdx%span != 0 || leafIdx+span > endLeafIdx {
+			level++
+			span /= s.idsPerNode
+		}
+		node, err := s.nodeAt(level, leafIdx)
 		if err != nil {
-			log.Errorf("fs.nodeWrite returned error: %s", err.Error())
+			return err
 		}
-		bytesWritten += subWriteEnd - subWriteStart
+		log.Tracef("discarding %d leaves from %d at level %d", span, leafIdx, level)
+		if level == s.depth {
+			s.nodeWrite(node, zeros)
+		} else {
+			atomic.AddInt64(&s.dirtyLeaves, -int64(pendingLeaves(node)))
+			node.id = ""
+			node.hash = ""
+			node.children = nil
+			s.markDirty(node)
+		}
+		leafIdx += span
 	}
+	return nil
+}
 
-	return bytesWritten, nil
+// Returns the number of leaves beneath a node which hold data not yet uploaded
+func pendingLeaves(node *Node) int {
+	if node.data != nil {
+		return 1
+	}
+	var pending int
+	for _, child := range node.children {
+		pending += pendingLeaves(child)
+	}
+	return pending
 }
 
-// Returns the root shortlink of the filesystem
+// Returns the root shortlink of the filesystem as of the last flush
 func (s *ShortenBlock) GetRootID() string {
-	return s.tree.id
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.rootID == "" {
+		// Volumes without a superblock are identified by their tree root until their first flush
+		return s.tree.id
+	}
+	return s.rootID
+}
+
+// Returns the checksum of the superblock, if the volume has checksums
+func (s *ShortenBlock) GetRootHash() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.rootHash
+}
+
+// Reports statistics and releases any files held open. Pending writes must already have been flushed
+func (s *ShortenBlock) Close() error {
+	s.readahead.close()
+	hits, misses := s.readCache.stats()
+	log.Debugf("read cache has %d hits and %d misses, holding %d bytes", hits, misses, s.readCache.bytes())
+	if s.cache != nil {
+		hits, misses = s.cache.stats()
+		log.Debugf("node cache has %d hits and %d misses so far", hits, misses)
+	}
+	if s.dedup == nil {
+		return nil
+	}
+	hits, misses = s.dedup.stats()
+	if hits+misses > 0 {
+		log.Infof("dedup index saved %d of %d uploads (%.1f%% hit rate)", hits, hits+misses,
+			100*float64(hits)/float64(hits+misses))
+	}
+	return s.dedup.close()
+}
+
+// Returns the depth of the node tree, which may have been discovered from the superblock
+func (s *ShortenBlock) Depth() int {
+	return s.depth
 }
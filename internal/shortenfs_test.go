@@ -0,0 +1,478 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/1ttric/shortenfs/internal/config"
+	"github.com/1ttric/shortenfs/internal/drivers"
+	_ "github.com/1ttric/shortenfs/internal/drivers/localdir"
+	"github.com/1ttric/shortenfs/internal/drivers/memory"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Drives many goroutines through a single ShortenBlock at once, alongside background flushes. Each goroutine owns a
+// region of the device which deliberately straddles leaf boundaries shared with its neighbours, so that concurrent
+// read-modify-writes of the same leaf are exercised. Intended to be run with the race detector enabled
+func TestConcurrentAccess(t *testing.T) {
+	const (
+		goroutines = 32
+		iterations = 200
+		regionSize = 150
+	)
+	driver := &memory.Memory{NodeBytes: 512, IdLength: 8}
+	cfg := config.ShortenBlockConfig{Driver: "memory", Depth: 2, MaxDirty: 16, Workers: 8}
+	block := NewShortenBlock(driver, cfg)
+	if block.Capacity() < goroutines*regionSize {
+		t.Fatalf("capacity %d too small for test", block.Capacity())
+	}
+
+	expected := make([]byte, goroutines*regionSize)
+	stop := make(chan struct{})
+	flusherDone := make(chan struct{})
+	go func() {
+		defer close(flusherDone)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := block.Flush(); err != nil {
+				t.Errorf("flush failed: %s", err.Error())
+				return
+			}
+			_ = block.GetRootID()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(g)))
+			region := expected[g*regionSize : (g+1)*regionSize]
+			for i := 0; i < iterations; i++ {
+				start := rng.Intn(regionSize)
+				data := make([]byte, rng.Intn(regionSize-start)+1)
+				rng.Read(data)
+				n, err := block.Write(g*regionSize+start, data)
+				if err != nil || n != len(data) {
+					t.Errorf("write of %d bytes returned %d, %v", len(data), n, err)
+					return
+				}
+				copy(region[start:], data)
+
+				read, err := block.Read(regionSize, g*regionSize)
+				if err != nil {
+					t.Errorf("read failed: %s", err.Error())
+					return
+				}
+				if !bytes.Equal(read, region) {
+					t.Errorf("goroutine %d read back unexpected data on iteration %d", g, i)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(stop)
+	<-flusherDone
+	if t.Failed() {
+		return
+	}
+
+	if err := block.Flush(); err != nil {
+		t.Fatalf("final flush failed: %s", err.Error())
+	}
+	cfg.RootID = block.GetRootID()
+	reopened := NewShortenBlock(driver, cfg)
+	read, err := reopened.Read(len(expected), 0)
+	if err != nil {
+		t.Fatalf("read after reopening failed: %s", err.Error())
+	}
+	if !bytes.Equal(read, expected) {
+		t.Fatalf("data read after reopening does not match what was written")
+	}
+}
+
+// Holds up every write until released, signalling each time one is held up
+type stallingDriver struct {
+	*memory.Memory
+	stalled chan struct{}
+	release chan struct{}
+}
+
+func (d *stallingDriver) Write(data []byte) (string, error) {
+	d.stalled <- struct{}{}
+	<-d.release
+	return d.Memory.Write(data)
+}
+
+// Reads and writes must carry on while a flush is waiting on the shortener, and writes made meanwhile must survive to
+// the next flush
+func TestAccessDuringFlush(t *testing.T) {
+	driver := &memory.Memory{NodeBytes: 512, IdLength: 8}
+	cfg := config.ShortenBlockConfig{Driver: "memory", Depth: 2, Workers: 4}
+	block := NewShortenBlock(driver, cfg)
+	first := bytes.Repeat([]byte{1}, 512)
+	if _, err := block.Write(0, first); err != nil {
+		t.Fatalf("write failed: %s", err.Error())
+	}
+	if err := block.Flush(); err != nil {
+		t.Fatalf("flush failed: %s", err.Error())
+	}
+
+	stalling := &stallingDriver{Memory: driver, stalled: make(chan struct{}, 16), release: make(chan struct{})}
+	block.shortener = stalling
+	second := bytes.Repeat([]byte{2}, 512)
+	if _, err := block.Write(512, second); err != nil {
+		t.Fatalf("write failed: %s", err.Error())
+	}
+	flushed := make(chan error)
+	go func() {
+		flushed <- block.Flush()
+	}()
+	<-stalling.stalled
+
+	third := bytes.Repeat([]byte{3}, 512)
+	done := make(chan error)
+	go func() {
+		if read, err := block.Read(1024, 0); err != nil || !bytes.Equal(read, append(first, second...)) {
+			done <- fmt.Errorf("read during flush returned unexpected data (%v)", err)
+			return
+		}
+		_, err := block.Write(1024, third)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("access during flush failed: %s", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("reads and writes were blocked by the flush")
+	}
+
+	close(stalling.release)
+	if err := <-flushed; err != nil {
+		t.Fatalf("flush failed: %s", err.Error())
+	}
+	if err := block.Flush(); err != nil {
+		t.Fatalf("flush failed: %s", err.Error())
+	}
+	cfg.RootID = block.GetRootID()
+	reopened := NewShortenBlock(driver, cfg)
+	read, err := reopened.Read(1536, 0)
+	if err != nil {
+		t.Fatalf("read after reopening failed: %s", err.Error())
+	}
+	if !bytes.Equal(read, append(append(first, second...), third...)) {
+		t.Fatalf("data read after reopening does not match what was written")
+	}
+}
+
+// Accesses beyond the end of the volume must fail, rather than wrap around onto its start
+func TestOutOfRange(t *testing.T) {
+	block := NewShortenBlock(&memory.Memory{NodeBytes: 512, IdLength: 8}, config.ShortenBlockConfig{Driver: "memory",
+		Depth: 1})
+	capacity := block.Capacity()
+	data := bytes.Repeat([]byte{1}, 512)
+	if _, err := block.Write(0, data); err != nil {
+		t.Fatalf("write failed: %s", err.Error())
+	}
+
+	if n, err := block.Write(capacity-4, make([]byte, 8)); err != syscall.ENOSPC || n != 0 {
+		t.Errorf("write past the end returned %d, %v", n, err)
+	}
+	if n, err := block.Write(capacity+512, make([]byte, 8)); err != syscall.ENOSPC || n != 0 {
+		t.Errorf("write after the end returned %d, %v", n, err)
+	}
+	if n, err := block.Write(math.MaxInt64-4, make([]byte, 8)); err != syscall.ENOSPC || n != 0 {
+		t.Errorf("write wrapping around returned %d, %v", n, err)
+	}
+	if err := block.Discard(capacity-4, 8); err != syscall.ENOSPC {
+		t.Errorf("discard past the end returned %v", err)
+	}
+	if read, err := block.Read(512, 0); err != nil || !bytes.Equal(read, data) {
+		t.Fatalf("accesses past the end changed the start of the volume (%v)", err)
+	}
+
+	if read, err := block.Read(8, capacity-4); err != nil || len(read) != 4 {
+		t.Errorf("read past the end returned %d bytes, %v", len(read), err)
+	}
+	if read, err := block.Read(8, capacity); err != nil || len(read) != 0 {
+		t.Errorf("read at the end returned %d bytes, %v", len(read), err)
+	}
+	if _, err := block.Read(8, capacity+512); err != syscall.EINVAL {
+		t.Errorf("read after the end returned %v", err)
+	}
+	if _, err := block.Read(8, -8); err != syscall.EINVAL {
+		t.Errorf("read before the start returned %v", err)
+	}
+}
+
+// Fails every write while down, as though the shortener were unreachable
+type unreachableDriver struct {
+	*memory.Memory
+	down bool
+}
+
+func (d *unreachableDriver) Write(data []byte) (string, error) {
+	if d.down {
+		return "", fmt.Errorf("shortener is down")
+	}
+	return d.Memory.Write(data)
+}
+
+// A write which fills the buffer must succeed even if the flush it triggers fails, as its data stays buffered until a
+// later flush uploads it
+func TestFlushFailure(t *testing.T) {
+	driver := &unreachableDriver{Memory: &memory.Memory{NodeBytes: 512, IdLength: 8}, down: true}
+	cfg := config.ShortenBlockConfig{Driver: "memory", Depth: 2, Workers: 4, MaxDirty: 2}
+	block := NewShortenBlock(driver, cfg)
+	data := bytes.Repeat([]byte("shortenfs"), 200)
+	if n, err := block.Write(100, data); err != nil || n != len(data) {
+		t.Fatalf("write which triggered a failed flush returned %d, %v", n, err)
+	}
+	if err := block.Flush(); err == nil {
+		t.Fatalf("flush succeeded while the shortener was down")
+	}
+	if read, err := block.Read(len(data), 100); err != nil || !bytes.Equal(read, data) {
+		t.Fatalf("buffered data does not read back after a failed flush (%v)", err)
+	}
+
+	driver.down = false
+	if err := block.Flush(); err != nil {
+		t.Fatalf("flush failed: %s", err.Error())
+	}
+	cfg.RootID, cfg.RootHash = block.GetRootID(), block.GetRootHash()
+	reopened, err := OpenReadOnly(driver.Memory, cfg)
+	if err != nil {
+		t.Fatalf("could not reopen volume: %s", err.Error())
+	}
+	if read, err := reopened.Read(len(data), 100); err != nil || !bytes.Equal(read, data) {
+		t.Fatalf("data read after reopening does not match what was written (%v)", err)
+	}
+}
+
+// The dedup index must never return IDs written to a different backend, or to a driver which forgets its nodes
+func TestDedupScope(t *testing.T) {
+	dir := t.TempDir()
+	index := filepath.Join(dir, "config.yml.dedup")
+	data := bytes.Repeat([]byte{7}, 1024)
+	write := func(path string) string {
+		cfg := config.ShortenBlockConfig{Driver: "localdir", Depth: 2, DedupIndex: index,
+			DriverOpts: map[string]interface{}{"path": path, "nodesize": 512}}
+		backend, err := drivers.Open(cfg.Driver, cfg.DriverOpts)
+		if err != nil {
+			t.Fatalf("could not open driver: %s", err.Error())
+		}
+		block := NewShortenBlock(backend, cfg)
+		if _, err = block.Write(0, data); err != nil {
+			t.Fatalf("write failed: %s", err.Error())
+		}
+		if err = block.Flush(); err != nil {
+			t.Fatalf("flush failed: %s", err.Error())
+		}
+		_ = block.Close()
+
+		cfg.RootID, cfg.RootHash, cfg.DedupIndex = block.GetRootID(), block.GetRootHash(), ""
+		reopened, err := OpenReadOnly(backend, cfg)
+		if err != nil {
+			t.Fatalf("could not reopen volume: %s", err.Error())
+		}
+		read, err := reopened.Read(len(data), 0)
+		if err != nil || !bytes.Equal(read, data) {
+			t.Fatalf("volume in %s does not read back what was written (%v)", path, err)
+		}
+		return cfg.RootID
+	}
+	// Identical contents in a new directory must be uploaded there, rather than refer to the first directory
+	write(filepath.Join(dir, "first"))
+	write(filepath.Join(dir, "second"))
+
+	block := NewShortenBlock(&memory.Memory{}, config.ShortenBlockConfig{Driver: "memory", Depth: 1, DedupIndex: index})
+	if block.dedup != nil {
+		t.Errorf("dedup index was used for the memory driver")
+	}
+}
+
+// Importing an image must skip its zero leaves, along with any subtree holding nothing else, and export back to
+// exactly the same image
+func TestImportZeros(t *testing.T) {
+	backend := &memory.Memory{NodeBytes: 512, IdLength: 8}
+	cfg := config.ShortenBlockConfig{Driver: "memory", Depth: 2, Workers: 4}
+	idsPerNode := NewShortenBlock(backend, cfg).idsPerNode
+
+	// Data in the first leaf and in the last two of the image, which ends partway through a leaf. Every leaf between
+	// them is zero, and so is the whole of the second subtree of the root
+	leaves := 2*idsPerNode + 3
+	image := make([]byte, (leaves-1)*512+100)
+	rand.New(rand.NewSource(1)).Read(image[:512])
+	rand.New(rand.NewSource(2)).Read(image[(leaves-2)*512:])
+	dir := t.TempDir()
+	imagePath := filepath.Join(dir, "image")
+	if err := ioutil.WriteFile(imagePath, image, 0o644); err != nil {
+		t.Fatalf("could not write image: %s", err.Error())
+	}
+
+	counter := &countingDriver{Driver: backend}
+	block, err := Import(counter, cfg, imagePath)
+	if err != nil {
+		t.Fatalf("import failed: %s", err.Error())
+	}
+	_ = block.Close()
+	// Three leaves, the first and third interior nodes below the root, the root and the superblock
+	if writes := atomic.LoadInt64(&counter.requests); writes != 7 {
+		t.Errorf("import uploaded %d nodes rather than 7", writes)
+	}
+
+	cfg.RootID, cfg.RootHash = block.GetRootID(), block.GetRootHash()
+	exportPath := filepath.Join(dir, "export")
+	if err = Export(backend, cfg, exportPath, false); err != nil {
+		t.Fatalf("export failed: %s", err.Error())
+	}
+	exported, err := ioutil.ReadFile(exportPath)
+	if err != nil {
+		t.Fatalf("could not read export: %s", err.Error())
+	}
+	if len(exported) != block.Capacity() {
+		t.Fatalf("export is %d bytes rather than the capacity of %d", len(exported), block.Capacity())
+	}
+	if !bytes.Equal(exported[:len(image)], image) || !allZero(exported[len(image):]) {
+		t.Errorf("export does not match the imported image")
+	}
+}
+
+// Nodes found broken by a repair must never be reused, either through the dedup index or the node cache. Nor may a
+// broken node be reused through an index which was not repaired
+func TestRepairForgetsBroken(t *testing.T) {
+	dir := t.TempDir()
+	cfgFile := filepath.Join(dir, "config.yml")
+	storage := filepath.Join(dir, "nodes")
+	cfg := config.ShortenBlockConfig{Driver: "localdir", Depth: 2,
+		DriverOpts: map[string]interface{}{"path": storage, "nodesize": 512}}
+	cfg.ApplyDefaults(cfgFile)
+	backend, err := drivers.Open(cfg.Driver, cfg.DriverOpts)
+	if err != nil {
+		t.Fatalf("could not open driver: %s", err.Error())
+	}
+	data := make([]byte, 512)
+	rand.New(rand.NewSource(1)).Read(data)
+	// Writes the data to the first leaf of the given volume, returning the leaf's ID and the new root
+	write := func(cfg config.ShortenBlockConfig) (string, config.ShortenBlockConfig) {
+		block, err := OpenShortenBlock(backend, cfg)
+		if err != nil {
+			t.Fatalf("could not open volume: %s", err.Error())
+		}
+		if _, err = block.Write(0, data); err != nil {
+			t.Fatalf("write failed: %s", err.Error())
+		}
+		if err = block.Flush(); err != nil {
+			t.Fatalf("flush failed: %s", err.Error())
+		}
+		leaf, err := block.getLeaf(0)
+		if err != nil {
+			t.Fatalf("could not find leaf: %s", err.Error())
+		}
+		_ = block.Close()
+		cfg.RootID, cfg.RootHash = block.GetRootID(), block.GetRootHash()
+		return leaf.id, cfg
+	}
+	// Checks that the given volume reads back the data from the shortener itself
+	check := func(cfg config.ShortenBlockConfig) {
+		cfg.CacheDir = ""
+		block, err := OpenReadOnly(backend, cfg)
+		if err != nil {
+			t.Fatalf("could not open volume: %s", err.Error())
+		}
+		if read, err := block.Read(len(data), 0); err != nil || !bytes.Equal(read, data) {
+			t.Errorf("volume does not read back what was written (%v)", err)
+		}
+	}
+
+	id, written := write(cfg)
+	if err = os.Remove(filepath.Join(storage, id)); err != nil {
+		t.Fatalf("could not remove leaf: %s", err.Error())
+	}
+	config.UseFile(cfgFile)
+	config.MainConfig = written
+	problems, err := Fsck(backend, written, true)
+	if err != nil || len(problems) != 1 || problems[0].NodeID != id {
+		t.Fatalf("repair found %v rather than leaf %s (%v)", problems, id, err)
+	}
+	cache, err := openDiskCache(cfg.CacheDir, 0)
+	if err != nil {
+		t.Fatalf("could not open node cache: %s", err.Error())
+	}
+	if _, ok := cache.get((&cachedDriver{driver: cfg.Driver}).entryName(id)); ok {
+		t.Errorf("broken leaf is still in the node cache")
+	}
+	index, err := openDedupIndex(cfg.DedupIndex, "")
+	if err != nil {
+		t.Fatalf("could not open dedup index: %s", err.Error())
+	}
+	for _, entry := range index.ids {
+		if entry == id {
+			t.Errorf("broken leaf is still in the dedup index")
+		}
+	}
+	_ = index.close()
+	_, repaired := write(config.MainConfig)
+	check(repaired)
+
+	// An index recording a node which has since been lost must not be trusted either
+	id, written = write(cfg)
+	if err = os.Remove(filepath.Join(storage, id)); err != nil {
+		t.Fatalf("could not remove leaf: %s", err.Error())
+	}
+	_, written = write(cfg)
+	check(written)
+}
+
+// Accepts writes, but loses every node written
+type writeOnlyDriver struct {
+	*memory.Memory
+}
+
+func (d *writeOnlyDriver) Read(id string) ([]byte, error) {
+	return nil, fmt.Errorf("node %s was lost", id)
+}
+
+// Migrations must verify the new volume against the shortener itself, rather than the node cache
+func TestMigrateVerifiesTarget(t *testing.T) {
+	source := &memory.Memory{NodeBytes: 512, IdLength: 8}
+	sourceConfig := config.ShortenBlockConfig{Driver: "memory", Depth: 2}
+	block := NewShortenBlock(source, sourceConfig)
+	if _, err := block.Write(1000, bytes.Repeat([]byte("shortenfs"), 200)); err != nil {
+		t.Fatalf("write failed: %s", err.Error())
+	}
+	if err := block.Flush(); err != nil {
+		t.Fatalf("flush failed: %s", err.Error())
+	}
+	sourceConfig.RootID, sourceConfig.RootHash = block.GetRootID(), block.GetRootHash()
+
+	dir := t.TempDir()
+	targetConfig := config.ShortenBlockConfig{Driver: "memory", CacheDir: filepath.Join(dir, "cache")}
+	migrated, err := Migrate(source, sourceConfig, &memory.Memory{NodeBytes: 256, IdLength: 8}, targetConfig)
+	if err != nil {
+		t.Fatalf("migration failed: %s", err.Error())
+	}
+	_ = migrated.Close()
+
+	targetConfig.CacheDir = filepath.Join(dir, "lossy-cache")
+	lossy := &writeOnlyDriver{Memory: &memory.Memory{NodeBytes: 256, IdLength: 8}}
+	if _, err = Migrate(source, sourceConfig, lossy, targetConfig); err == nil {
+		t.Errorf("migration to a shortener which lost every node succeeded")
+	}
+}
@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"github.com/1ttric/shortenfs/internal/config"
+	"github.com/1ttric/shortenfs/internal/drivers"
+	"github.com/1ttric/shortenfs/internal/drivers/compress"
+	"github.com/1ttric/shortenfs/internal/drivers/encrypt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+)
+
+const (
+	encryptionMethod = "aes-256-gcm"
+	// Sealed into the superblock, so that a wrong key is noticed before any tree nodes are read
+	keyCheckPlaintext = "shortenfs"
+)
+
+// Returns the encryption key configured for a volume, or nil if none is configured. Passphrases are stretched using
+// the salt recorded in the superblock, which is generated here for new volumes
+func volumeKey(sb *superblock, config config.ShortenBlockConfig) ([]byte, error) {
+	switch {
+	case config.Passphrase != "" && config.KeyFile != "":
+		return nil, fmt.Errorf("only one of a passphrase or key file may be configured")
+	case config.KeyFile != "":
+		contents, err := ioutil.ReadFile(config.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read key file")
+		}
+		return encrypt.FileKey(contents), nil
+	case config.Passphrase != "":
+		if sb.Salt == nil {
+			sb.Salt = make([]byte, 16)
+			if _, err := rand.Read(sb.Salt); err != nil {
+				return nil, errors.Wrap(err, "could not generate salt")
+			}
+		}
+		return encrypt.DeriveKey(config.Passphrase, sb.Salt), nil
+	}
+	return nil, nil
+}
+
+// Layers the transformations recorded in the superblock over the backend driver. On write, nodes are compressed
+// before being encrypted, since ciphertext does not compress
+func (s *ShortenBlock) stackDrivers(sb *superblock, config config.ShortenBlockConfig) (drivers.Driver, error) {
+	shortener := s.backend
+
+	key, err := volumeKey(sb, config)
+	if err != nil {
+		return nil, err
+	}
+	if sb.Encryption == "" && key != nil && sb.Version == 0 && sb.Root == "" {
+		// Only new volumes can have encryption enabled
+		sb.Encryption = encryptionMethod
+	}
+	if sb.Encryption != "" {
+		if sb.Encryption != encryptionMethod {
+			return nil, fmt.Errorf("unsupported encryption method %s", sb.Encryption)
+		}
+		if key == nil {
+			return nil, fmt.Errorf("volume is encrypted, but no passphrase or key file is configured")
+		}
+		encryptor, err := encrypt.New(shortener, key)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid encryption key")
+		}
+		if sb.KeyCheck == nil {
+			if sb.KeyCheck, err = encryptor.Seal([]byte(keyCheckPlaintext)); err != nil {
+				return nil, errors.Wrap(err, "could not seal key check")
+			}
+		} else if check, err := encryptor.Open(sb.KeyCheck); err != nil || !bytes.Equal(check, []byte(keyCheckPlaintext)) {
+			return nil, fmt.Errorf("the configured passphrase or key file does not match this volume")
+		}
+		shortener = encryptor
+	} else if key != nil {
+		return nil, fmt.Errorf("a passphrase or key file is configured, but the volume is not encrypted")
+	}
+
+	if sb.Compression != "" {
+		compressor, err := compress.New(shortener, sb.Compression)
+		if err != nil {
+			return nil, err
+		}
+		shortener = compressor
+	}
+	return shortener, nil
+}
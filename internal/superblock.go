@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/1ttric/shortenfs/internal/config"
+	"github.com/1ttric/shortenfs/internal/drivers"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	superblockMagic = "shortenfs"
+	// Incremented whenever the on-shortener layout of a volume changes incompatibly. Version 2 added checksums, so
+	// volumes without them are still written as version 1
+	formatVersion = 2
+)
+
+// Describes the geometry of a volume, and is written to the shortener alongside the root of its node tree. The ID of
+// the superblock is what identifies a volume, so that it can be mounted without knowing anything else about it
+type superblock struct {
+	Magic      string `json:"magic"`
+	Version    int    `json:"version"`
+	Driver     string `json:"driver"`
+	Depth      int    `json:"depth"`
+	IdsPerNode int    `json:"idspernode"`
+	NodeSize   int    `json:"nodesize"`
+	// ID of the top-level node of the tree, and its checksum
+	Root     string `json:"root"`
+	RootHash string `json:"roothash,omitempty"`
+	// Checksum method with which every node of the tree is verified against its parent, if any
+	Checksum string `json:"checksum,omitempty"`
+	// Compression method applied to every node of the tree, if any
+	Compression string `json:"compression,omitempty"`
+	// Encryption method applied to every node of the tree, if any, along with the salt used to derive the key from a
+	// passphrase and a sealed known value used to check the key
+	Encryption string `json:"encryption,omitempty"`
+	Salt       []byte `json:"salt,omitempty"`
+	KeyCheck   []byte `json:"keycheck,omitempty"`
+}
+
+// Parses a superblock from node data, returning false if the data is not a superblock at all
+func parseSuperblock(data []byte) (*superblock, bool) {
+	var sb superblock
+	if err := json.Unmarshal(bytes.TrimRight(data, "\x00"), &sb); err != nil || sb.Magic != superblockMagic {
+		return nil, false
+	}
+	return &sb, true
+}
+
+// Loads the volume identified by the configured root ID, discovering its geometry from the superblock and refusing
+// to continue if it conflicts with the config. Volumes created before superblocks existed have their tree root as the
+// root ID - these are still accepted, and gain a superblock on their next flush
+func (s *ShortenBlock) loadSuperblock(config config.ShortenBlockConfig) (*superblock, error) {
+	data, err := drivers.ReadVerified(s.backend, config.RootID, func(data []byte) error {
+		if config.RootHash != "" && nodeChecksum(data) != config.RootHash {
+			return fmt.Errorf("volume root %s does not match its checksum %s", config.RootID, config.RootHash)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read volume root %s", config.RootID)
+	}
+	sb, ok := parseSuperblock(data)
+	if !ok {
+		if config.Depth <= 0 {
+			return nil, fmt.Errorf("volume %s has no superblock, so its depth must be configured", config.RootID)
+		}
+		if config.Compression != "" || config.Passphrase != "" || config.KeyFile != "" {
+			return nil, fmt.Errorf("volume %s has no superblock, so it cannot use compression or encryption", config.RootID)
+		}
+		log.Infof("volume %s has no superblock - one will be written on the next flush", config.RootID)
+		return &superblock{Driver: config.Driver, Depth: config.Depth, Root: config.RootID}, nil
+	}
+
+	if sb.Version > formatVersion {
+		return nil, fmt.Errorf("volume format version %d is newer than the supported version %d", sb.Version, formatVersion)
+	}
+	if config.Driver != "" && sb.Driver != config.Driver {
+		return nil, fmt.Errorf("volume was created with driver %s, but driver %s is configured", sb.Driver, config.Driver)
+	}
+	if config.Depth > 0 && sb.Depth != config.Depth {
+		return nil, fmt.Errorf("volume has depth %d, but depth %d is configured", sb.Depth, config.Depth)
+	}
+	if sb.Checksum != "" && sb.Checksum != checksumMethod {
+		return nil, fmt.Errorf("unsupported checksum method %s", sb.Checksum)
+	}
+	if config.Compression != "" && sb.Compression != config.Compression {
+		return nil, fmt.Errorf("volume uses compression %q, but %q is configured", sb.Compression, config.Compression)
+	}
+	log.Debugf("volume %s has depth %d and tree root %s", config.RootID, sb.Depth, sb.Root)
+	s.rootID = config.RootID
+	s.rootHash = config.RootHash
+	return sb, nil
+}
+
+// Refuses to continue if the driver stack would lay out the tree differently to when the volume was created
+func (s *ShortenBlock) checkGeometry(sb *superblock) error {
+	if sb.NodeSize != s.shortener.NodeSize() || sb.IdsPerNode != s.idsPerNode {
+		return fmt.Errorf("volume has node size %d with %d IDs per node, but the driver provides node size %d with %d IDs "+
+			"per node", sb.NodeSize, sb.IdsPerNode, s.shortener.NodeSize(), s.idsPerNode)
+	}
+	return nil
+}
+
+// Uploads a superblock describing the current tree, and makes it the new root of the volume. The superblock is
+// written directly to the backend, so that it can always be read before knowing how the rest of the tree is stored.
+// The tree root only changes during flushes, so this must be called while flushing or before the volume is in use
+func (s *ShortenBlock) writeSuperblock() error {
+	sb := s.volume
+	sb.Magic = superblockMagic
+	sb.Version = 1
+	if sb.Checksum != "" {
+		sb.Version = 2
+	}
+	sb.IdsPerNode = s.idsPerNode
+	sb.NodeSize = s.shortener.NodeSize()
+	sb.Root = s.tree.id
+	sb.RootHash = s.tree.hash
+	data, err := json.Marshal(sb)
+	if err != nil {
+		return err
+	}
+	if len(data) > s.backend.NodeSize() {
+		return fmt.Errorf("superblock of %d bytes does not fit in node size %d", len(data), s.backend.NodeSize())
+	}
+	s.workers <- struct{}{}
+	id, err := s.backend.Write(data)
+	<-s.workers
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rootID = id
+	s.rootHash = ""
+	if sb.Checksum != "" {
+		s.rootHash = nodeChecksum(data)
+	}
+	return nil
+}